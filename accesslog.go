@@ -0,0 +1,238 @@
+package shorturl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type AccessLogFormat int
+
+const (
+	AccessLogJson AccessLogFormat = iota // JSON Lines
+	AccessLogClf                         // Common Log Format, followed by the fields of the link
+)
+
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch s {
+	case "json":
+		return AccessLogJson, nil
+	case "clf":
+		return AccessLogClf, nil
+	}
+	return 0, fmt.Errorf("unknown access log format %q, json or clf expected", s)
+}
+
+// AccessLogEntry is a request served by the redirecter
+type AccessLogEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Uri        string
+	Proto      string
+	Code       string // the last path segment requested
+	NodeId     int64  // -1 if not resolved
+	Url        string // the destination, empty if not resolved
+	Status     int
+	Bytes      int64
+	Latency    time.Duration
+	CacheHit   bool
+}
+
+// AccessLog writes the entries in background, so the requests are never
+// blocked on the writer; the entries are dropped if the buffer is full.
+type AccessLog struct {
+	w       io.Writer
+	format  AccessLogFormat
+	sample  float64
+	lines   chan []byte
+	dropped atomic.Int64
+	wg      sync.WaitGroup
+}
+
+// NewAccessLog logs the fraction sample of the requests, 1 for all of them;
+// the ones failed (5xx) are always logged.
+func NewAccessLog(w io.Writer, format AccessLogFormat, sample float64, bufferSize int) *AccessLog {
+	a := &AccessLog{w: w, format: format, sample: sample, lines: make(chan []byte, bufferSize)}
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+func (a *AccessLog) Log(e *AccessLogEntry) {
+	if e.Status < 500 && a.sample < 1 && rand.Float64() >= a.sample {
+		return
+	}
+	select {
+	case a.lines <- a.formatEntry(e):
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+func (a *AccessLog) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Close writes the pending entries, and closes the writer if it's an io.Closer
+// other than stdout & stderr.
+func (a *AccessLog) Close() error {
+	close(a.lines)
+	a.wg.Wait()
+	if c, ok := a.w.(io.Closer); ok && a.w != os.Stdout && a.w != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+func (a *AccessLog) run() {
+	defer a.wg.Done()
+	for line := range a.lines {
+		if _, err := a.w.Write(line); err != nil {
+			log.Printf("failed on writing access log: %v", err)
+		}
+	}
+}
+
+type accessLogJson struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	Uri       string  `json:"uri"`
+	Code      string  `json:"code"`
+	Node      *int64  `json:"node"`
+	Url       string  `json:"url,omitempty"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	LatencyMs float64 `json:"latency_ms"`
+	CacheHit  bool    `json:"cache_hit"`
+}
+
+func (a *AccessLog) formatEntry(e *AccessLogEntry) []byte {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	latencyMs := float64(e.Latency.Microseconds()) / 1000
+	if a.format == AccessLogClf {
+		node, dst, cacheHit := "-", "-", "miss"
+		if e.NodeId >= 0 {
+			node = strconv.FormatInt(e.NodeId, 10)
+		}
+		if e.Url != "" {
+			dst = e.Url
+		}
+		if e.CacheHit {
+			cacheHit = "hit"
+		}
+		return fmt.Appendf(nil, "%s - - [%s] %q %d %d %q %s %q %.3f %s\n",
+			host, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method+" "+e.Uri+" "+e.Proto, e.Status, e.Bytes,
+			e.Code, node, dst, latencyMs, cacheHit)
+	}
+	j := accessLogJson{
+		Time:      e.Time.Format(time.RFC3339Nano),
+		Remote:    host,
+		Method:    e.Method,
+		Uri:       e.Uri,
+		Code:      e.Code,
+		Url:       e.Url,
+		Status:    e.Status,
+		Bytes:     e.Bytes,
+		LatencyMs: latencyMs,
+		CacheHit:  e.CacheHit,
+	}
+	if e.NodeId >= 0 {
+		j.Node = &e.NodeId
+	}
+	line, _ := json.Marshal(j)
+	return append(line, '\n')
+}
+
+// RotatingFile is appended to until reaching maxSize bytes, then renamed to
+// <path>.1 with the older ones shifted to <path>.2 and so on, keeping
+// backups of them at most.
+type RotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Write keeps appending to the current file if rotating fails, which is
+// retried after another maxSize bytes
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rotateErr error
+	if r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if rotateErr = r.rotate(); rotateErr != nil {
+			r.size = 0
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("failed on rotating %s: %w", r.path, rotateErr)
+	}
+	return n, err
+}
+
+// rotate renames the file before closing it, so it's still written to if any step fails
+func (r *RotatingFile) rotate() error {
+	if r.backups <= 0 {
+		if err := r.f.Truncate(0); err != nil {
+			return err
+		}
+		r.size = 0
+		return nil
+	}
+	for i := r.backups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
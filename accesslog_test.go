@@ -0,0 +1,138 @@
+package shorturl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRedirecter_AccessLog(t *testing.T) {
+	redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/log", 8)
+	dst := "https://example.mrzm.io/" + randStr(18)
+	id, err := mgr.InsertOrReuse(dst, -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	serve := func(format AccessLogFormat, sample float64, paths ...string) []string {
+		var buf bytes.Buffer
+		accessLog := NewAccessLog(&buf, format, sample, 16)
+		redirecter.SetAccessLog(accessLog)
+		for _, path := range paths {
+			redirecter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+		redirecter.SetAccessLog(nil)
+		if err := accessLog.Close(); err != nil {
+			t.Fatal("failed on closing access log.", err)
+		}
+		return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	lines := serve(AccessLogJson, 1, "/log/"+id.Base58(), "/log/nothing")
+	var logged []accessLogJson
+	for _, line := range lines {
+		var j accessLogJson
+		if err = json.Unmarshal([]byte(line), &j); err != nil {
+			t.Fatal("invalid json line.", line, err)
+		}
+		logged = append(logged, j)
+	}
+	if len(logged) != 2 || logged[0].Code != id.Base58() || logged[0].Node == nil || *logged[0].Node != 8 ||
+		logged[0].Url != dst || logged[0].Status != 302 || logged[0].Method != "GET" || logged[0].Uri != "/log/"+id.Base58() || logged[0].Remote != "192.0.2.1" {
+		t.Fatal("redirect not logged", lines)
+	}
+	if logged[1].Node != nil || logged[1].Url != "" || logged[1].Status != 404 || logged[1].Bytes != int64(len("not found")) {
+		t.Fatal("not found not logged", lines)
+	}
+
+	lines = serve(AccessLogClf, 1, "/log/"+id.Base58(), "/log/nothing")
+	clf := regexp.MustCompile(`^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}] "GET /log/\S+ HTTP/1\.1" 302 \d+ "` + id.Base58() + `" 8 "` + regexp.QuoteMeta(dst) + `" \d+\.\d{3} hit$`)
+	if len(lines) != 2 || !clf.MatchString(lines[0]) || !strings.Contains(lines[1], `" 404 9 "nothing" - "-" `) {
+		t.Fatal("clf not match", lines)
+	}
+
+	if lines = serve(AccessLogJson, 0, "/log/"+id.Base58(), "/log/nothing"); len(lines) != 1 || lines[0] != "" {
+		t.Fatal("should not be logged without sampling", lines)
+	}
+
+	protected, err := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, Password: "s3cret"})
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if lines = serve(AccessLogJson, 1, "/log/"+protected.Base58()); len(lines) != 1 || !strings.Contains(lines[0], `"status":401`) || strings.Contains(lines[0], dst) {
+		t.Fatal("destination of protected links should not be logged", lines)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal("failed on opening.", err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatal("failed on writing.", err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal("failed on closing.", err)
+	}
+	for name, expected := range map[string]string{"access.log": "line 4\n", "access.log.1": "line 3\n", "access.log.2": "line 2\n"} {
+		if content, err := os.ReadFile(filepath.Join(filepath.Dir(path), name)); err != nil || string(content) != expected {
+			t.Error("content not match", name, string(content), err)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("should keep 2 backups only")
+	}
+
+	// a failed rotation keeps writing to the current file, and is retried later
+	path = filepath.Join(t.TempDir(), "failing.log")
+	if err = os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal("failed on creating dir.", err)
+	}
+	if f, err = OpenRotatingFile(path, 10, 1); err != nil {
+		t.Fatal("failed on opening.", err)
+	}
+	if _, err = f.Write([]byte("line 1\n")); err != nil {
+		t.Fatal("failed on writing.", err)
+	}
+	if n, err := f.Write([]byte("line 2\n")); err == nil || n != 7 {
+		t.Fatal("should report the failed rotation after writing", n, err)
+	}
+	if err = os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal("failed on removing dir.", err)
+	}
+	if _, err = f.Write([]byte("line 3\n")); err != nil {
+		t.Fatal("failed on writing.", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal("failed on closing.", err)
+	}
+	for name, expected := range map[string]string{"failing.log": "line 3\n", "failing.log.1": "line 1\nline 2\n"} {
+		if content, err := os.ReadFile(filepath.Join(filepath.Dir(path), name)); err != nil || string(content) != expected {
+			t.Error("content not match", name, string(content), err)
+		}
+	}
+
+	path = filepath.Join(t.TempDir(), "truncated.log")
+	if f, err = OpenRotatingFile(path, 10, 0); err != nil {
+		t.Fatal("failed on opening.", err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n"} {
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatal("failed on writing.", err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal("failed on closing.", err)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "line 2\n" {
+		t.Error("should be truncated without backups", string(content), err)
+	}
+}
@@ -0,0 +1,268 @@
+package shorturl
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/snowflake"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const ApiPrefix = "/api/links"
+
+type linkRequest struct {
+	Url          string `json:"url"`
+	ExpireAt     int64  `json:"expire_at,omitempty"`
+	ExpireIn     int64  `json:"expire_in,omitempty"`
+	ActivateAt   int64  `json:"activate_at,omitempty"`
+	ActivateIn   int64  `json:"activate_in,omitempty"`
+	RedirectCode int    `json:"redirect_code,omitempty"`
+	MaxVisits    int64  `json:"max_visits,omitempty"`
+}
+
+// linkUpdate leaves the absent fields unchanged, expire_at <= 0 means never expire
+type linkUpdate struct {
+	Url          *string `json:"url"`
+	ExpireAt     *int64  `json:"expire_at"`
+	ExpireIn     *int64  `json:"expire_in"`
+	RedirectCode *int    `json:"redirect_code"`
+}
+
+type linkResponse struct {
+	Id           string `json:"id"`
+	ShortUrl     string `json:"short_url"`
+	Url          string `json:"url"`
+	ExpireAt     *int64 `json:"expire_at"`
+	ActivateAt   *int64 `json:"activate_at"`
+	Disabled     bool   `json:"disabled"`
+	RedirectCode int    `json:"redirect_code"`
+	VisitsLeft   *int64 `json:"visits_left"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewApi requires the requests to carry the token as `Authorization: Bearer <token>`,
+// all of them are refused if the token is empty
+func NewApi(mgr *Manager, redirecter *Redirecter, token string) *Api {
+	return &Api{mgr, redirecter, token}
+}
+
+func (a *Api) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+ApiPrefix, a.create)
+	mux.HandleFunc("GET "+ApiPrefix+"/{id}", a.get)
+	mux.HandleFunc("PATCH "+ApiPrefix+"/{id}", a.update)
+	mux.HandleFunc("DELETE "+ApiPrefix+"/{id}", a.delete)
+	mux.HandleFunc("POST "+ApiPrefix+"/{id}/disable", a.setDisabled(true))
+	mux.HandleFunc("POST "+ApiPrefix+"/{id}/enable", a.setDisabled(false))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.authorized(req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJson(w, 401, errorResponse{"unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+func (a *Api) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// writeLinkError answers 400 for the invalid attributes, 500 for the others
+func writeLinkError(w http.ResponseWriter, id string, err error) {
+	var invalid *InvalidLinkError
+	if errors.As(err, &invalid) {
+		writeJson(w, 400, errorResponse{err.Error()})
+		return
+	}
+	log.Printf("failed on writing link %s: %v", id, err)
+	writeJson(w, 500, errorResponse{"temporarily error"})
+}
+
+func (a *Api) create(w http.ResponseWriter, req *http.Request) {
+	var body linkRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJson(w, 400, errorResponse{"invalid json body"})
+		return
+	}
+	expireAt := int64(-1)
+	if body.ExpireAt > 0 {
+		expireAt = body.ExpireAt
+	} else if body.ExpireIn > 0 {
+		expireAt = time.Now().Unix() + body.ExpireIn
+	}
+	activateAt := body.ActivateAt
+	if activateAt <= 0 && body.ActivateIn > 0 {
+		activateAt = time.Now().Unix() + body.ActivateIn
+	}
+	id, err := a.mgr.InsertOrReuseWithOptions(body.Url, LinkOptions{ExpireAt: expireAt, ActivateAt: activateAt, RedirectCode: body.RedirectCode, MaxVisits: body.MaxVisits})
+	if err != nil {
+		writeLinkError(w, body.Url, err)
+		return
+	}
+	entry, err := a.mgr.Query(id)
+	if err != nil || entry == nil {
+		log.Printf("failed on querying created link %s: %v", id.Base58(), err)
+		writeJson(w, 500, errorResponse{"temporarily error"})
+		return
+	}
+	writeJson(w, 201, a.toResponse(entry))
+}
+
+func (a *Api) get(w http.ResponseWriter, req *http.Request) {
+	id, ok := parseIdParam(w, req)
+	if !ok {
+		return
+	}
+	entry, err := a.mgr.Query(id)
+	if err != nil {
+		log.Printf("failed on querying %s: %v", id.Base58(), err)
+		writeJson(w, 500, errorResponse{"temporarily error"})
+		return
+	}
+	if entry == nil {
+		writeJson(w, 404, errorResponse{"not found"})
+		return
+	}
+	writeJson(w, 200, a.toResponse(entry))
+}
+
+func (a *Api) update(w http.ResponseWriter, req *http.Request) {
+	id, ok := parseIdParam(w, req)
+	if !ok {
+		return
+	}
+	var body linkUpdate
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJson(w, 400, errorResponse{"invalid json body"})
+		return
+	}
+	entry, err := a.mgr.Query(id)
+	if err != nil {
+		log.Printf("failed on querying %s: %v", id.Base58(), err)
+		writeJson(w, 500, errorResponse{"temporarily error"})
+		return
+	}
+	if entry == nil {
+		writeJson(w, 404, errorResponse{"not found"})
+		return
+	}
+	update := LinkUpdate{Url: body.Url, RedirectCode: body.RedirectCode}
+	if body.ExpireAt != nil || body.ExpireIn != nil {
+		expireAt := int64(-1)
+		if body.ExpireAt != nil {
+			expireAt = *body.ExpireAt
+		} else if *body.ExpireIn > 0 {
+			expireAt = time.Now().Unix() + *body.ExpireIn
+		}
+		update.ExpireAt = &expireAt
+	}
+	if err = a.mgr.Update(id, update); err != nil {
+		writeLinkError(w, id.Base58(), err)
+		return
+	}
+	a.redirecter.Invalidate(id)
+	entry, err = a.mgr.Query(id)
+	if err != nil || entry == nil {
+		log.Printf("failed on querying updated link %s: %v", id.Base58(), err)
+		writeJson(w, 500, errorResponse{"temporarily error"})
+		return
+	}
+	writeJson(w, 200, a.toResponse(entry))
+}
+
+func (a *Api) delete(w http.ResponseWriter, req *http.Request) {
+	id, ok := parseIdParam(w, req)
+	if !ok {
+		return
+	}
+	entry, err := a.mgr.Query(id)
+	if err != nil {
+		log.Printf("failed on querying %s: %v", id.Base58(), err)
+		writeJson(w, 500, errorResponse{"temporarily error"})
+		return
+	}
+	if entry == nil {
+		writeJson(w, 404, errorResponse{"not found"})
+		return
+	}
+	if err = a.mgr.Delete(id); err != nil {
+		log.Printf("failed on deleting %s: %v", id.Base58(), err)
+		writeJson(w, 500, errorResponse{"temporarily error"})
+		return
+	}
+	a.redirecter.Invalidate(id)
+	w.WriteHeader(204)
+}
+
+func (a *Api) setDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, ok := parseIdParam(w, req)
+		if !ok {
+			return
+		}
+		entry, err := a.mgr.Query(id)
+		if err != nil {
+			log.Printf("failed on querying %s: %v", id.Base58(), err)
+			writeJson(w, 500, errorResponse{"temporarily error"})
+			return
+		}
+		if entry == nil {
+			writeJson(w, 404, errorResponse{"not found"})
+			return
+		}
+		if disabled {
+			err = a.mgr.Disable(id)
+		} else {
+			err = a.mgr.Enable(id)
+		}
+		if err != nil {
+			log.Printf("failed on updating %s: %v", id.Base58(), err)
+			writeJson(w, 500, errorResponse{"temporarily error"})
+			return
+		}
+		a.redirecter.Invalidate(id)
+		entry.Disabled = disabled
+		writeJson(w, 200, a.toResponse(entry))
+	}
+}
+
+func (a *Api) toResponse(entry *UrlEntry) linkResponse {
+	id := snowflake.ID(entry.Id)
+	resp := linkResponse{Id: id.Base58(), ShortUrl: a.redirecter.ShortUrl(id), Url: entry.Url, Disabled: entry.Disabled, RedirectCode: entryRedirectCode(entry)}
+	if entry.ExpireAt.Valid {
+		expireAt := entry.ExpireAt.Int64
+		resp.ExpireAt = &expireAt
+	}
+	if entry.ActivateAt.Valid {
+		activateAt := entry.ActivateAt.Int64
+		resp.ActivateAt = &activateAt
+	}
+	if entry.VisitsLeft.Valid {
+		visitsLeft := entry.VisitsLeft.Int64
+		resp.VisitsLeft = &visitsLeft
+	}
+	return resp
+}
+
+func parseIdParam(w http.ResponseWriter, req *http.Request) (snowflake.ID, bool) {
+	id, err := snowflake.ParseBase58([]byte(req.PathValue("id")))
+	if err != nil {
+		writeJson(w, 404, errorResponse{"not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,176 @@
+package shorturl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createApi(t *testing.T) *Api {
+	files, _, _, _, _ := initTest(1, 0, t)
+	bk, err := SqliteOpen(files[0], true, 0)
+	if err != nil {
+		t.Fatal("failed on opening db.", err)
+	}
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	redirecter, err := NewRedirecter(files, "https://r.mrzm.io/api", false, false)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	return NewApi(mgr, redirecter, testApiToken)
+}
+
+const testApiToken = "test-token"
+
+func doApi(t *testing.T, handler http.Handler, method string, path string, body string) (*httptest.ResponseRecorder, linkResponse) {
+	req, err := http.NewRequest(method, "https://api.mrzm.io"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal("failed on creating http req.", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testApiToken)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var resp linkResponse
+	if rr.Code == 200 || rr.Code == 201 {
+		if err = json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal("failed on decoding response.", err)
+		}
+	}
+	return rr, resp
+}
+
+func TestApi_General(t *testing.T) {
+	handler := createApi(t).Handler()
+
+	rr, created := doApi(t, handler, "POST", ApiPrefix, `{"url":"https://test.mrzm.io/api1"}`)
+	if rr.Code != 201 {
+		t.Fatal("should be created, got", rr.Code)
+	}
+	if created.ShortUrl != "https://r.mrzm.io/api/"+created.Id {
+		t.Error("short url not match:", created.ShortUrl)
+	}
+	if created.ExpireAt != nil {
+		t.Error("should not expire")
+	}
+
+	rr, reused := doApi(t, handler, "POST", ApiPrefix, `{"url":"https://test.mrzm.io/api1"}`)
+	if rr.Code != 201 || reused.Id != created.Id {
+		t.Error("should reuse id")
+	}
+
+	rr, expiring := doApi(t, handler, "POST", ApiPrefix, `{"url":"https://test.mrzm.io/api2","expire_in":60}`)
+	if rr.Code != 201 {
+		t.Fatal("should be created, got", rr.Code)
+	}
+	if expiring.ExpireAt == nil || *expiring.ExpireAt <= time.Now().Unix() {
+		t.Error("should expire in the future")
+	}
+
+	rr, fetched := doApi(t, handler, "GET", ApiPrefix+"/"+created.Id, "")
+	if rr.Code != 200 || fetched.Url != "https://test.mrzm.io/api1" {
+		t.Error("failed on get")
+	}
+
+	rr, updated := doApi(t, handler, "PATCH", ApiPrefix+"/"+created.Id, `{"url":"https://test.mrzm.io/api3","expire_in":60}`)
+	if rr.Code != 200 || updated.Url != "https://test.mrzm.io/api3" || updated.ExpireAt == nil {
+		t.Error("failed on update, got", rr.Code)
+	}
+	rr, updated = doApi(t, handler, "PATCH", ApiPrefix+"/"+created.Id, `{"expire_at":0}`)
+	if rr.Code != 200 || updated.Url != "https://test.mrzm.io/api3" || updated.ExpireAt != nil {
+		t.Error("failed on clearing expiry, got", rr.Code)
+	}
+	rr, _ = doApi(t, handler, "PATCH", ApiPrefix+"/"+created.Id, `{"url":"bad"}`)
+	if rr.Code != 400 {
+		t.Error("should be bad request, got", rr.Code)
+	}
+	rr, _ = doApi(t, handler, "PATCH", ApiPrefix+"/"+created.Id, `{"url":"https://test.mrzm.io/api4","redirect_code":303}`)
+	if rr.Code != 400 {
+		t.Error("should be bad request, got", rr.Code)
+	}
+	rr, got := doApi(t, handler, "GET", ApiPrefix+"/"+created.Id, "")
+	if rr.Code != 200 || got.Url != "https://test.mrzm.io/api3" || got.RedirectCode != 302 {
+		t.Error("should be unchanged by the invalid update", got)
+	}
+
+	rr, disabled := doApi(t, handler, "POST", ApiPrefix+"/"+created.Id+"/disable", "")
+	if rr.Code != 200 || !disabled.Disabled {
+		t.Error("should be disabled, got", rr.Code)
+	}
+	rr, enabled := doApi(t, handler, "POST", ApiPrefix+"/"+created.Id+"/enable", "")
+	if rr.Code != 200 || enabled.Disabled {
+		t.Error("should be enabled, got", rr.Code)
+	}
+
+	rr, _ = doApi(t, handler, "DELETE", ApiPrefix+"/"+created.Id, "")
+	if rr.Code != 204 {
+		t.Error("should be deleted, got", rr.Code)
+	}
+	rr, _ = doApi(t, handler, "GET", ApiPrefix+"/"+created.Id, "")
+	if rr.Code != 404 {
+		t.Error("should be gone, got", rr.Code)
+	}
+	rr, _ = doApi(t, handler, "DELETE", ApiPrefix+"/"+created.Id, "")
+	if rr.Code != 404 {
+		t.Error("should be not found, got", rr.Code)
+	}
+
+	rr, _ = doApi(t, handler, "POST", ApiPrefix, `{"url":"not a url"}`)
+	if rr.Code != 400 {
+		t.Error("should be bad request, got", rr.Code)
+	}
+	rr, _ = doApi(t, handler, "GET", ApiPrefix+"/0OIl", "")
+	if rr.Code != 404 {
+		t.Error("should be not found for invalid id, got", rr.Code)
+	}
+}
+
+func TestApi_Unauthorized(t *testing.T) {
+	handler := createApi(t).Handler()
+	for _, authorization := range []string{"", "Bearer", "Bearer wrong-token", "Basic " + testApiToken, testApiToken} {
+		req := httptest.NewRequest("POST", "https://api.mrzm.io"+ApiPrefix, strings.NewReader(`{"url":"https://test.mrzm.io/api1"}`))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != 401 || rr.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Error("should be unauthorized", authorization, rr.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "https://api.mrzm.io"+ApiPrefix+"/0OIl", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rr := httptest.NewRecorder()
+	NewApi(nil, nil, "").Handler().ServeHTTP(rr, req)
+	if rr.Code != 401 {
+		t.Error("should refuse all if no token, got", rr.Code)
+	}
+}
+
+func TestApi_BackendError(t *testing.T) {
+	api := createApi(t)
+	handler := api.Handler()
+	rr, created := doApi(t, handler, "POST", ApiPrefix, `{"url":"https://test.mrzm.io/api1"}`)
+	if rr.Code != 201 {
+		t.Fatal("should be created, got", rr.Code)
+	}
+	_ = api.mgr.bk.Close()
+	rr, _ = doApi(t, handler, "POST", ApiPrefix, `{"url":"https://test.mrzm.io/api2"}`)
+	if rr.Code != 500 {
+		t.Error("should be internal error, got", rr.Code)
+	}
+	rr, _ = doApi(t, handler, "POST", ApiPrefix, `{"url":"bad"}`)
+	if rr.Code != 400 {
+		t.Error("should be bad request, got", rr.Code)
+	}
+	rr, _ = doApi(t, handler, "PATCH", ApiPrefix+"/"+created.Id, `{"url":"https://test.mrzm.io/api3"}`)
+	if rr.Code != 500 {
+		t.Error("should be internal error, got", rr.Code)
+	}
+}
@@ -0,0 +1,23 @@
+package shorturl
+
+import "strings"
+
+// OpenBackend opens a postgres backend if source is a postgres:// DSN, an
+// in-memory one for "memory:", otherwise a sqlite file
+func OpenBackend(source string, isWrite bool, nodeId int64) (Backend, error) {
+	if IsPostgresDsn(source) {
+		return PostgresOpen(source, isWrite, nodeId)
+	}
+	if IsMemorySource(source) {
+		return MemoryOpen(nodeId)
+	}
+	return SqliteOpen(source, isWrite, nodeId)
+}
+
+func IsMemorySource(source string) bool {
+	return strings.HasPrefix(source, "memory:")
+}
+
+func IsSqliteSource(source string) bool {
+	return !IsPostgresDsn(source) && !IsMemorySource(source)
+}
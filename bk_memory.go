@@ -0,0 +1,319 @@
+package shorturl
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryBackend keeps everything in memory, for tests & ephemeral deployments
+type memoryBackend struct {
+	mu      sync.RWMutex
+	nodeId  int64
+	entries map[uint64]*UrlEntry
+	byUrl   map[string]map[uint64]struct{}
+	aliases map[string]uint64
+	hits    map[uint64]map[string]int64
+	history map[uint64][]HistoryEntry
+}
+
+func MemoryOpen(nodeId int64) (*memoryBackend, error) {
+	if nodeId < 0 || nodeId > 1023 {
+		return nil, fmt.Errorf("%v is not a valid snowflake node id", nodeId)
+	}
+	return &memoryBackend{
+		nodeId:  nodeId,
+		entries: make(map[uint64]*UrlEntry),
+		byUrl:   make(map[string]map[uint64]struct{}),
+		aliases: make(map[string]uint64),
+		hits:    make(map[uint64]map[string]int64),
+		history: make(map[uint64][]HistoryEntry),
+	}, nil
+}
+
+func isAlive(entry *UrlEntry, now int64) bool {
+	return (!entry.ExpireAt.Valid || entry.ExpireAt.Int64 > now) && (!entry.VisitsLeft.Valid || entry.VisitsLeft.Int64 > 0)
+}
+
+func isActive(entry *UrlEntry, now int64) bool {
+	return !entry.ActivateAt.Valid || entry.ActivateAt.Int64 <= now
+}
+
+func (m *memoryBackend) InsertUrl(entry *UrlEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[entry.Id]; ok {
+		return fmt.Errorf("id %d already exists", entry.Id)
+	}
+	copied := *entry
+	m.entries[entry.Id] = &copied
+	m.indexUrl(&copied)
+	return nil
+}
+
+func (m *memoryBackend) InsertUrls(entries []UrlEntry) ([]error, error) {
+	errs := make([]error, len(entries))
+	for i := range entries {
+		errs[i] = m.InsertUrl(&entries[i])
+	}
+	return errs, nil
+}
+
+// Walk iterates over a snapshot, so fn is free to modify the backend
+func (m *memoryBackend) Walk(fn func(entry *UrlEntry) error) error {
+	m.mu.RLock()
+	entries := make([]UrlEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, *entry)
+	}
+	m.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id < entries[j].Id
+	})
+	for i := range entries {
+		if err := fn(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) ListUrls(filter LinkFilter) ([]UrlEntry, error) {
+	m.mu.RLock()
+	now := time.Now().Unix()
+	result := make([]UrlEntry, 0)
+	for _, entry := range m.entries {
+		if filter.matches(entry, now) {
+			result = append(result, *entry)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id > result[j].Id
+	})
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[:filter.Limit]
+	}
+	return result, nil
+}
+
+func (m *memoryBackend) indexUrl(entry *UrlEntry) {
+	ids, ok := m.byUrl[entry.Url]
+	if !ok {
+		ids = make(map[uint64]struct{})
+		m.byUrl[entry.Url] = ids
+	}
+	ids[entry.Id] = struct{}{}
+}
+
+func (m *memoryBackend) unindexUrl(entry *UrlEntry) {
+	if ids, ok := m.byUrl[entry.Url]; ok {
+		delete(ids, entry.Id)
+		if len(ids) == 0 {
+			delete(m.byUrl, entry.Url)
+		}
+	}
+}
+
+func (m *memoryBackend) QueryByUrl(url string) ([]UrlEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now().Unix()
+	result := make([]UrlEntry, 0)
+	for id := range m.byUrl[url] {
+		entry := m.entries[id]
+		if !entry.Disabled && isAlive(entry, now) && isActive(entry, now) {
+			result = append(result, *entry)
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryBackend) QueryById(id uint64) (*UrlEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry, ok := m.entries[id]
+	now := time.Now().Unix()
+	if !ok || !isAlive(entry, now) || !isActive(entry, now) {
+		return nil, nil
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+func (m *memoryBackend) Delete(id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(id)
+	return nil
+}
+
+func (m *memoryBackend) deleteLocked(id uint64) {
+	if entry, ok := m.entries[id]; ok {
+		m.unindexUrl(entry)
+		delete(m.entries, id)
+	}
+	for alias, aliasedId := range m.aliases {
+		if aliasedId == id {
+			delete(m.aliases, alias)
+		}
+	}
+	delete(m.hits, id)
+	delete(m.history, id)
+}
+
+func (m *memoryBackend) SetDisabled(id uint64, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.entries[id]; ok {
+		entry.Disabled = disabled
+	}
+	return nil
+}
+
+func (m *memoryBackend) ConsumeVisit(id uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok || !entry.VisitsLeft.Valid || entry.VisitsLeft.Int64 <= 0 {
+		return false, nil
+	}
+	entry.VisitsLeft.Int64--
+	return true, nil
+}
+
+func (m *memoryBackend) QueryPending(id uint64) (*UrlEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry, ok := m.entries[id]
+	now := time.Now().Unix()
+	if !ok || !isAlive(entry, now) || isActive(entry, now) {
+		return nil, nil
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+func (m *memoryBackend) UpdateLink(id uint64, update *LinkUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok {
+		return fmt.Errorf("id %d not found", id)
+	}
+	if update.Url != nil && *update.Url != entry.Url {
+		m.history[id] = append(m.history[id], HistoryEntry{Id: id, Url: entry.Url, ExpireAt: entry.ExpireAt, ChangedAt: time.Now().Unix()})
+		m.unindexUrl(entry)
+		entry.Url = *update.Url
+		m.indexUrl(entry)
+	}
+	if update.ExpireAt != nil {
+		entry.ExpireAt = nullableExpiry(*update.ExpireAt)
+	}
+	if update.RedirectCode != nil {
+		entry.RedirectCode = *update.RedirectCode
+	}
+	return nil
+}
+
+func (m *memoryBackend) QueryHistory(id uint64) ([]HistoryEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append(make([]HistoryEntry, 0), m.history[id]...), nil
+}
+
+func (m *memoryBackend) InsertAlias(alias string, id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.aliases[alias]; ok {
+		return fmt.Errorf("alias %q already exists", alias)
+	}
+	m.aliases[alias] = id
+	return nil
+}
+
+func (m *memoryBackend) QueryAlias(alias string) (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.aliases[alias], nil
+}
+
+func (m *memoryBackend) QueryAliases() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	aliases := make([]string, 0, len(m.aliases))
+	for alias := range m.aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases, nil
+}
+
+func (m *memoryBackend) AddHitCounts(counts []HitCount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range counts {
+		days, ok := m.hits[c.Id]
+		if !ok {
+			days = make(map[string]int64)
+			m.hits[c.Id] = days
+		}
+		days[c.Day] += c.Count
+	}
+	return nil
+}
+
+func (m *memoryBackend) QueryHitCounts(id uint64) ([]HitCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make([]HitCount, 0, len(m.hits[id]))
+	for day, count := range m.hits[id] {
+		result = append(result, HitCount{Id: id, Day: day, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Day < result[j].Day
+	})
+	return result, nil
+}
+
+func (m *memoryBackend) DeleteExpired(limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	deleted := int64(0)
+	for id, entry := range m.entries {
+		if deleted >= int64(limit) {
+			break
+		}
+		if !isAlive(entry, now) {
+			m.deleteLocked(id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *memoryBackend) Info() (*BackendInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	info := &BackendInfo{Kind: "memory", NodeId: m.nodeId, Urls: int64(len(m.entries)), Aliases: int64(len(m.aliases))}
+	now := time.Now().Unix()
+	for _, entry := range m.entries {
+		if !isAlive(entry, now) {
+			info.Expired++
+		}
+		if entry.Disabled {
+			info.Disabled++
+		}
+	}
+	return info, nil
+}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
+
+func (m *memoryBackend) getNodeId() (int64, error) {
+	return m.nodeId, nil
+}
@@ -0,0 +1,493 @@
+package shorturl
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// schema migrations of the postgres backend, schema version is the count applied
+var pgMigrations = []string{
+	`CREATE TABLE url (
+		id BIGINT NOT NULL PRIMARY KEY,
+		url TEXT NOT NULL,
+		expire_at BIGINT,
+		disabled BOOLEAN NOT NULL DEFAULT FALSE);
+	CREATE INDEX url_url ON url (url);
+	CREATE TABLE alias (
+		alias TEXT NOT NULL PRIMARY KEY,
+		id BIGINT NOT NULL);
+	CREATE TABLE hit_daily (
+		id BIGINT NOT NULL,
+		day TEXT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (id, day));
+	CREATE TABLE url_history (
+		id BIGINT NOT NULL,
+		url TEXT NOT NULL,
+		expire_at BIGINT,
+		changed_at BIGINT NOT NULL,
+		seq BIGSERIAL);
+	CREATE INDEX url_history_id ON url_history (id);`,
+	`ALTER TABLE url ADD COLUMN redirect_code INTEGER NOT NULL DEFAULT 302;`,
+	`ALTER TABLE url ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE url ADD COLUMN visits_left BIGINT;`,
+	`ALTER TABLE url ADD COLUMN activate_at BIGINT;`,
+	`CREATE INDEX url_expire_at ON url (expire_at);
+	CREATE INDEX url_visits_left ON url (visits_left);`,
+}
+
+const (
+	pgMaxOpenConns    = 16
+	pgMaxIdleConns    = 4
+	pgConnMaxLifetime = 30 * time.Minute
+	// arbitrary key of the advisory lock serializing schema migrations
+	pgMigrationLock = 0x7375726c
+)
+
+type postgresBackend struct {
+	db     *sql.DB
+	nodeId int64
+
+	insertUrl      *sql.Stmt
+	queryByUrl     *sql.Stmt
+	queryById      *sql.Stmt
+	setDisabled    *sql.Stmt
+	insertAlias    *sql.Stmt
+	queryAlias     *sql.Stmt
+	addHitCount    *sql.Stmt
+	queryHitCounts *sql.Stmt
+	queryHistory   *sql.Stmt
+}
+
+func IsPostgresDsn(source string) bool {
+	return strings.HasPrefix(source, "postgres://") || strings.HasPrefix(source, "postgresql://")
+}
+
+// PostgresOpen opens the database of a node, creating & upgrading its schema
+// only if isWrite, while a reader fails on an outdated one. A database holds
+// one node, whose ids are generated by its writer: never run two writers of
+// the same node id at once, their ids may collide.
+func PostgresOpen(dsn string, isWrite bool, nodeId int64) (*postgresBackend, error) {
+	if isWrite && (nodeId < 0 || nodeId > 1023) {
+		return nil, fmt.Errorf("%v is not a valid snowflake node id", nodeId)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(pgMaxOpenConns)
+	db.SetMaxIdleConns(pgMaxIdleConns)
+	db.SetConnMaxLifetime(pgConnMaxLifetime)
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	var dbNodeId int64
+	if isWrite {
+		dbNodeId, _, _, err = pgMigrate(db, nodeId)
+	} else {
+		dbNodeId, err = pgCheckSchema(db)
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if isWrite && dbNodeId != nodeId {
+		_ = db.Close()
+		return nil, fmt.Errorf("node id is not identical, expected %d, actually got %d", dbNodeId, nodeId)
+	}
+	p := &postgresBackend{db: db, nodeId: dbNodeId}
+	if err = p.prepare(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// PostgresMigrate upgrades the schema of an initialized DB, returns the schema version before & after
+func PostgresMigrate(dsn string) (int, int, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	_, from, to, err := pgMigrate(db, -1)
+	return from, to, err
+}
+
+// pgMigrate initializes the DB with the node id if needed, or fails if the
+// node id is negative, then upgrades the schema. Returns the node id of the
+// DB, and the schema version before & after.
+func pgMigrate(db *sql.DB, nodeId int64) (int64, int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, pgMigrationLock); err != nil {
+		return 0, 0, 0, err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS surl_meta (
+		key TEXT NOT NULL PRIMARY KEY,
+		value BIGINT NOT NULL)`)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var dbNodeId int64
+	err = tx.QueryRow(`SELECT value FROM surl_meta WHERE key = 'node_id'`).Scan(&dbNodeId)
+	if err == sql.ErrNoRows {
+		if nodeId < 0 {
+			return 0, 0, 0, fmt.Errorf("db is not initialized")
+		}
+		dbNodeId = nodeId
+		_, err = tx.Exec(`INSERT INTO surl_meta(key, value) VALUES ('node_id', $1), ('schema_version', 0)`, nodeId)
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var from int
+	if err = tx.QueryRow(`SELECT value FROM surl_meta WHERE key = 'schema_version'`).Scan(&from); err != nil {
+		return 0, 0, 0, err
+	}
+	if from > len(pgMigrations) {
+		return 0, 0, 0, fmt.Errorf("db schema version %d is newer than supported %d", from, len(pgMigrations))
+	}
+	for version := from; version < len(pgMigrations); version++ {
+		if _, err = tx.Exec(pgMigrations[version]); err != nil {
+			return 0, 0, 0, fmt.Errorf("failed on migrating to schema version %d: %w", version+1, err)
+		}
+	}
+	if _, err = tx.Exec(`UPDATE surl_meta SET value = $1 WHERE key = 'schema_version'`, len(pgMigrations)); err != nil {
+		return 0, 0, 0, err
+	}
+	return dbNodeId, from, len(pgMigrations), tx.Commit()
+}
+
+// pgCheckSchema returns the node id of the DB, failing if the schema is not up to date
+func pgCheckSchema(db *sql.DB) (int64, error) {
+	var initialized bool
+	if err := db.QueryRow(`SELECT to_regclass('surl_meta') IS NOT NULL`).Scan(&initialized); err != nil {
+		return 0, err
+	}
+	var dbNodeId int64
+	var version int
+	if initialized {
+		err := db.QueryRow(`SELECT n.value, v.value FROM surl_meta n, surl_meta v
+			WHERE n.key = 'node_id' AND v.key = 'schema_version'`).Scan(&dbNodeId, &version)
+		if err == sql.ErrNoRows {
+			initialized = false
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if !initialized {
+		return 0, fmt.Errorf("db is not initialized")
+	}
+	if version > len(pgMigrations) {
+		return 0, fmt.Errorf("db schema version %d is newer than supported %d, please upgrade", version, len(pgMigrations))
+	}
+	if version < len(pgMigrations) {
+		return 0, fmt.Errorf("db schema version %d is outdated, please run `surl-mgr migrate` first", version)
+	}
+	return dbNodeId, nil
+}
+
+// pgParam formats the n-th placeholder
+func pgParam(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+const pgContains = `strpos(%s, %s) > 0`
+
+func (p *postgresBackend) prepare() error {
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&p.insertUrl, `INSERT INTO url(` + urlColumns + `) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`},
+		{&p.queryByUrl, `SELECT ` + urlColumns + ` FROM url WHERE url = $1 AND NOT disabled AND (expire_at IS NULL OR expire_at > $2) AND (visits_left IS NULL OR visits_left > 0) AND (activate_at IS NULL OR activate_at <= $2)`},
+		{&p.queryById, `SELECT ` + urlColumns + ` FROM url WHERE id = $1 AND (expire_at IS NULL OR expire_at > $2) AND (visits_left IS NULL OR visits_left > 0) AND (activate_at IS NULL OR activate_at <= $2)`},
+		{&p.setDisabled, `UPDATE url SET disabled = $1 WHERE id = $2`},
+		{&p.insertAlias, `INSERT INTO alias(alias, id) VALUES ($1,$2)`},
+		{&p.queryAlias, `SELECT id FROM alias WHERE alias = $1`},
+		{&p.addHitCount, `INSERT INTO hit_daily(id, day, count) VALUES ($1,$2,$3)
+			ON CONFLICT (id, day) DO UPDATE SET count = hit_daily.count + excluded.count`},
+		{&p.queryHitCounts, `SELECT id, day, count FROM hit_daily WHERE id = $1 ORDER BY day`},
+		{&p.queryHistory, `SELECT id, url, expire_at, changed_at FROM url_history WHERE id = $1 ORDER BY changed_at, seq`},
+	}
+	for _, s := range stmts {
+		stmt, err := p.db.Prepare(s.query)
+		if err != nil {
+			return err
+		}
+		*s.stmt = stmt
+	}
+	return nil
+}
+
+func (p *postgresBackend) InsertUrl(entry *UrlEntry) error {
+	_, err := p.insertUrl.Exec(entryArgs(entry)...)
+	return err
+}
+
+func (p *postgresBackend) InsertUrls(entries []UrlEntry) ([]error, error) {
+	errs := make([]error, len(entries))
+	err := p.inTx(func(tx *sql.Tx) error {
+		stmt := tx.Stmt(p.insertUrl)
+		// a failed statement aborts the whole transaction in postgres, unless rolled back to a savepoint
+		for i, entry := range entries {
+			if _, err := tx.Exec(`SAVEPOINT bulk`); err != nil {
+				return err
+			}
+			if _, errs[i] = stmt.Exec(entryArgs(&entry)...); errs[i] != nil {
+				if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT bulk`); err != nil {
+					return err
+				}
+			} else if _, err := tx.Exec(`RELEASE SAVEPOINT bulk`); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+func (p *postgresBackend) Walk(fn func(entry *UrlEntry) error) error {
+	row, err := p.db.Query(`SELECT ` + urlColumns + ` FROM url ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	for row.Next() {
+		entry, err := scanEntry(row)
+		if err != nil {
+			return err
+		}
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return row.Err()
+}
+
+func (p *postgresBackend) ListUrls(filter LinkFilter) ([]UrlEntry, error) {
+	query, args := listUrlsQuery(&filter, time.Now().Unix(), pgParam, pgContains)
+	return queryEntries(p.db, query, args...)
+}
+
+func (p *postgresBackend) QueryByUrl(url string) ([]UrlEntry, error) {
+	row, err := p.queryByUrl.Query(url, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	result := make([]UrlEntry, 0)
+	for row.Next() {
+		entry, err := scanEntry(row)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *entry)
+	}
+	return result, row.Err()
+}
+
+func (p *postgresBackend) QueryById(id uint64) (*UrlEntry, error) {
+	entry, err := scanEntry(p.queryById.QueryRow(int64(id), time.Now().Unix()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return entry, err
+}
+
+func (p *postgresBackend) Delete(id uint64) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		for _, table := range []string{"url", "alias", "hit_daily", "url_history"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE id = $1`, int64(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *postgresBackend) SetDisabled(id uint64, disabled bool) error {
+	_, err := p.setDisabled.Exec(disabled, int64(id))
+	return err
+}
+
+func (p *postgresBackend) ConsumeVisit(id uint64) (bool, error) {
+	result, err := p.db.Exec(`UPDATE url SET visits_left = visits_left - 1 WHERE id = $1 AND visits_left > 0`, int64(id))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (p *postgresBackend) QueryPending(id uint64) (*UrlEntry, error) {
+	entry, err := scanEntry(p.db.QueryRow(`SELECT `+urlColumns+` FROM url WHERE id = $1 AND activate_at > $2 AND (expire_at IS NULL OR expire_at > $2)`, int64(id), time.Now().Unix()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return entry, err
+}
+
+func (p *postgresBackend) UpdateLink(id uint64, update *LinkUpdate) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		var current string
+		err := tx.QueryRow(`SELECT url FROM url WHERE id = $1 FOR UPDATE`, int64(id)).Scan(&current)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("id %d not found", id)
+		} else if err != nil {
+			return err
+		}
+		if update.Url != nil && *update.Url != current {
+			_, err = tx.Exec(`INSERT INTO url_history(id, url, expire_at, changed_at)
+				SELECT id, url, expire_at, $1 FROM url WHERE id = $2`, time.Now().Unix(), int64(id))
+			if err != nil {
+				return err
+			}
+		}
+		query, args := updateLinkQuery(update, id, pgParam)
+		if query == "" {
+			return nil
+		}
+		_, err = tx.Exec(query, args...)
+		return err
+	})
+}
+
+func (p *postgresBackend) QueryHistory(id uint64) ([]HistoryEntry, error) {
+	row, err := p.queryHistory.Query(int64(id))
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	result := make([]HistoryEntry, 0)
+	for row.Next() {
+		var h HistoryEntry
+		if err = row.Scan(&h.Id, &h.Url, &h.ExpireAt, &h.ChangedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, h)
+	}
+	return result, row.Err()
+}
+
+func (p *postgresBackend) InsertAlias(alias string, id uint64) error {
+	_, err := p.insertAlias.Exec(alias, int64(id))
+	return err
+}
+
+func (p *postgresBackend) QueryAlias(alias string) (uint64, error) {
+	var id uint64
+	err := p.queryAlias.QueryRow(alias).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func (p *postgresBackend) QueryAliases() ([]string, error) {
+	return queryAliases(p.db)
+}
+
+func (p *postgresBackend) AddHitCounts(counts []HitCount) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		stmt := tx.Stmt(p.addHitCount)
+		for _, c := range counts {
+			if _, err := stmt.Exec(int64(c.Id), c.Day, c.Count); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *postgresBackend) QueryHitCounts(id uint64) ([]HitCount, error) {
+	row, err := p.queryHitCounts.Query(int64(id))
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	result := make([]HitCount, 0)
+	for row.Next() {
+		var c HitCount
+		if err = row.Scan(&c.Id, &c.Day, &c.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, row.Err()
+}
+
+func (p *postgresBackend) DeleteExpired(limit int) (int64, error) {
+	// the CTE is evaluated once, so the same ids are deleted from every table
+	// without ordering them, the indexes on expire_at & visits_left are used
+	res, err := p.db.Exec(`WITH expired AS (
+			SELECT id FROM url WHERE (expire_at IS NOT NULL AND expire_at <= $1) OR visits_left <= 0
+			LIMIT $2 FOR UPDATE SKIP LOCKED),
+		a AS (DELETE FROM alias WHERE id IN (SELECT id FROM expired)),
+		h AS (DELETE FROM hit_daily WHERE id IN (SELECT id FROM expired)),
+		u AS (DELETE FROM url_history WHERE id IN (SELECT id FROM expired))
+		DELETE FROM url WHERE id IN (SELECT id FROM expired)`, time.Now().Unix(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (p *postgresBackend) Info() (*BackendInfo, error) {
+	info := &BackendInfo{Kind: "postgres", NodeId: p.nodeId, LatestSchemaVersion: len(pgMigrations)}
+	err := p.db.QueryRow(`SELECT value FROM surl_meta WHERE key = 'schema_version'`).Scan(&info.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	err = p.db.QueryRow(`SELECT COUNT(1),
+			COUNT(1) FILTER (WHERE (expire_at IS NOT NULL AND expire_at <= $1) OR visits_left <= 0),
+			COUNT(1) FILTER (WHERE disabled) FROM url`, time.Now().Unix()).Scan(&info.Urls, &info.Expired, &info.Disabled)
+	if err != nil {
+		return nil, err
+	}
+	err = p.db.QueryRow(`SELECT COUNT(1) FROM alias`).Scan(&info.Aliases)
+	return info, err
+}
+
+func (p *postgresBackend) Close() error {
+	return p.db.Close()
+}
+
+func (p *postgresBackend) getNodeId() (int64, error) {
+	return p.nodeId, nil
+}
+
+func (p *postgresBackend) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
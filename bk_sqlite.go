@@ -5,12 +5,14 @@ import (
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"os"
+	"strings"
 	"time"
 )
 
 type sqliteBackend struct {
 	db      *sql.DB
 	version int64
+	changes *sqliteChanges
 }
 
 func SqliteOpen(filename string, isWrite bool, nodeId int64) (*sqliteBackend, error) {
@@ -29,7 +31,7 @@ func SqliteOpen(filename string, isWrite bool, nodeId int64) (*sqliteBackend, er
 	} else if err != nil {
 		return nil, err
 	}
-	db, err := sql.Open("sqlite3", filename)
+	db, err := sql.Open("sqlite3", sqliteDsn(filename))
 	if err != nil {
 		return nil, err
 	}
@@ -38,13 +40,22 @@ func SqliteOpen(filename string, isWrite bool, nodeId int64) (*sqliteBackend, er
 		if err != nil {
 			return nil, err
 		}
-		err = createTables(db)
-		if err != nil {
+		if _, _, err = sqliteMigrate(db, nodeId); err != nil {
 			return nil, err
 		}
 	}
-	s := &sqliteBackend{db, 0}
-	dbNodeId, err := s.getNodeId()
+	version, err := sqliteSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(sqliteMigrations) {
+		return nil, fmt.Errorf("db schema version %d is newer than supported %d, please upgrade", version, len(sqliteMigrations))
+	}
+	if version < len(sqliteMigrations) {
+		return nil, fmt.Errorf("db schema version %d is outdated, please run `surl-mgr migrate` first", version)
+	}
+	s := &sqliteBackend{db, int64(version), newSqliteChanges(filename)}
+	dbNodeId, err := s.checkNodeId()
 	if err != nil {
 		return nil, err
 	}
@@ -54,41 +65,304 @@ func SqliteOpen(filename string, isWrite bool, nodeId int64) (*sqliteBackend, er
 	return s, nil
 }
 
-func createTables(db *sql.DB) error {
-	ddl := `CREATE TABLE url (
+// sqliteDsn begins the transactions by BEGIN IMMEDIATE, so the ones reading
+// before writing wait for the lock of another writer by the busy timeout
+// instead of failing on upgrading it with SQLITE_BUSY at once
+func sqliteDsn(filename string) string {
+	return filename + "?_txlock=immediate"
+}
+
+const urlColumns = `id, url, expire_at, disabled, redirect_code, password_hash, visits_left, activate_at`
+
+// entryArgs returns the values of the entry in the order of urlColumns
+func entryArgs(entry *UrlEntry) []any {
+	return []any{entry.Id, entry.Url, entry.ExpireAt, entry.Disabled, entry.RedirectCode, entry.PasswordHash, entry.VisitsLeft, entry.ActivateAt}
+}
+
+func nullableExpiry(expireAt int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: expireAt, Valid: expireAt > 0}
+}
+
+// updateLinkQuery builds the UPDATE of the fields set for the sql backends,
+// param formats the n-th placeholder; the id is the last parameter
+func updateLinkQuery(u *LinkUpdate, id uint64, param func(n int) string) (string, []any) {
+	var sets []string
+	var args []any
+	set := func(column string, v any) {
+		args = append(args, v)
+		sets = append(sets, column+` = `+param(len(args)))
+	}
+	if u.Url != nil {
+		set(`url`, *u.Url)
+	}
+	if u.ExpireAt != nil {
+		set(`expire_at`, nullableExpiry(*u.ExpireAt))
+	}
+	if u.RedirectCode != nil {
+		set(`redirect_code`, *u.RedirectCode)
+	}
+	if len(sets) == 0 {
+		return ``, nil
+	}
+	args = append(args, int64(id))
+	return `UPDATE url SET ` + strings.Join(sets, `, `) + ` WHERE id = ` + param(len(args)), args
+}
+
+func urlTableDdl(table string) string {
+	return `CREATE TABLE ` + table + ` (
 			"id" INTEGER NOT NULL PRIMARY KEY,
 			"url" TEXT NOT NULL,
-			"expire_at" INTEGER);`
-	stmt, err := db.Prepare(ddl)
+			"expire_at" INTEGER,
+			"disabled" INTEGER NOT NULL DEFAULT 0,
+			"redirect_code" INTEGER NOT NULL DEFAULT 302,
+			"password_hash" TEXT NOT NULL DEFAULT '',
+			"visits_left" INTEGER,
+			"activate_at" INTEGER);`
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanEntry(row rowScanner) (*UrlEntry, error) {
+	var entry UrlEntry
+	err := row.Scan(&entry.Id, &entry.Url, &entry.ExpireAt, &entry.Disabled, &entry.RedirectCode, &entry.PasswordHash, &entry.VisitsLeft, &entry.ActivateAt)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *sqliteBackend) InsertUrl(entry *UrlEntry) error {
+	query := `INSERT INTO url(` + urlColumns + `) VALUES (?,?,?,?,?,?,?,?)`
+	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec()
+	_, err = stmt.Exec(entryArgs(entry)...)
 	return err
 }
 
-func (s *sqliteBackend) InsertUrl(entry *UrlEntry) error {
-	query := `INSERT INTO url(id, url, expire_at) VALUES (?,?,?)`
+func (s *sqliteBackend) InsertUrls(entries []UrlEntry) ([]error, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO url(` + urlColumns + `) VALUES (?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	// a failed statement doesn't abort the transaction in sqlite
+	errs := make([]error, len(entries))
+	for i, entry := range entries {
+		_, errs[i] = stmt.Exec(entryArgs(&entry)...)
+	}
+	return errs, tx.Commit()
+}
+
+func (s *sqliteBackend) Walk(fn func(entry *UrlEntry) error) error {
+	row, err := s.db.Query(`SELECT ` + urlColumns + ` FROM url ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	for row.Next() {
+		entry, err := scanEntry(row)
+		if err != nil {
+			return err
+		}
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return row.Err()
+}
+
+func (s *sqliteBackend) ListUrls(filter LinkFilter) ([]UrlEntry, error) {
+	query, args := listUrlsQuery(&filter, time.Now().Unix(), func(n int) string {
+		return fmt.Sprintf("?%d", n)
+	}, `instr(%s, %s) > 0`)
+	return queryEntries(s.db, query, args...)
+}
+
+// queryEntries runs the query selecting urlColumns
+func queryEntries(db *sql.DB, query string, args ...any) ([]UrlEntry, error) {
+	row, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	result := make([]UrlEntry, 0)
+	for row.Next() {
+		entry, err := scanEntry(row)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *entry)
+	}
+	return result, row.Err()
+}
+
+func (s *sqliteBackend) SetDisabled(id uint64, disabled bool) error {
+	query := `UPDATE url SET disabled=? WHERE id=?`
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(entry.Id, entry.Url, entry.ExpireAt)
+	_, err = stmt.Exec(disabled, id)
 	return err
 }
 
 func (s *sqliteBackend) Delete(id uint64) error {
-	query := `DELETE FROM url WHERE id=?`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	for _, table := range []string{"url", "alias", "hit_daily", "url_history"} {
+		if _, err = tx.Exec(`DELETE FROM `+table+` WHERE id=?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteBackend) ConsumeVisit(id uint64) (consumed bool, err error) {
+	err = s.changes.own(func() error {
+		result, err := s.db.Exec(`UPDATE url SET visits_left=visits_left-1 WHERE id=? AND visits_left > 0`, id)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		consumed = affected > 0
+		return err
+	})
+	return consumed, err
+}
+
+func (s *sqliteBackend) QueryPending(id uint64) (*UrlEntry, error) {
+	entry, err := scanEntry(s.db.QueryRow(`SELECT `+urlColumns+` FROM url WHERE id = ?1 AND activate_at > ?2 AND (expire_at IS NULL OR expire_at > ?2)`, id, time.Now().Unix()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return entry, err
+}
+
+// UpdateLink reads the current url before writing, the transaction begins
+// immediately by sqliteDsn to wait for another writer
+func (s *sqliteBackend) UpdateLink(id uint64, update *LinkUpdate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	var current string
+	if err = tx.QueryRow(`SELECT url FROM url WHERE id=?`, id).Scan(&current); err == sql.ErrNoRows {
+		return fmt.Errorf("id %d not found", id)
+	} else if err != nil {
+		return err
+	}
+	if update.Url != nil && *update.Url != current {
+		_, err = tx.Exec(`INSERT INTO url_history(id, url, expire_at, changed_at)
+			SELECT id, url, expire_at, ? FROM url WHERE id=?`, time.Now().Unix(), id)
+		if err != nil {
+			return err
+		}
+	}
+	query, args := updateLinkQuery(update, id, func(n int) string {
+		return fmt.Sprintf("?%d", n)
+	})
+	if query != "" {
+		if _, err = tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteBackend) QueryHistory(id uint64) ([]HistoryEntry, error) {
+	query := `SELECT id, url, expire_at, changed_at FROM url_history WHERE id = ? ORDER BY changed_at, rowid`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	row, err := stmt.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	result := make([]HistoryEntry, 0)
+	for row.Next() {
+		var h HistoryEntry
+		if err = row.Scan(&h.Id, &h.Url, &h.ExpireAt, &h.ChangedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, h)
+	}
+	return result, nil
+}
+
+func (s *sqliteBackend) InsertAlias(alias string, id uint64) error {
+	query := `INSERT INTO alias(alias, id) VALUES (?,?)`
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(id)
+	_, err = stmt.Exec(alias, id)
 	return err
 }
 
+func (s *sqliteBackend) QueryAlias(alias string) (uint64, error) {
+	query := `SELECT id FROM alias WHERE alias = ?`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	var id uint64
+	err = stmt.QueryRow(alias).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func (s *sqliteBackend) QueryAliases() ([]string, error) {
+	return queryAliases(s.db)
+}
+
+// queryAliases selects all the aliases, shared with postgres
+func queryAliases(db *sql.DB) ([]string, error) {
+	row, err := db.Query(`SELECT alias FROM alias ORDER BY alias`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	aliases := make([]string, 0)
+	for row.Next() {
+		var alias string
+		if err = row.Scan(&alias); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, row.Err()
+}
+
 func (s *sqliteBackend) QueryByUrl(url string) ([]UrlEntry, error) {
-	query := `SELECT * FROM url WHERE url = ? AND (expire_at IS NULL OR expire_at > ?)`
+	query := `SELECT ` + urlColumns + ` FROM url WHERE url = ?1 AND disabled = 0 AND (expire_at IS NULL OR expire_at > ?2) AND (visits_left IS NULL OR visits_left > 0) AND (activate_at IS NULL OR activate_at <= ?2)`
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return nil, err
@@ -103,12 +377,61 @@ func (s *sqliteBackend) QueryByUrl(url string) ([]UrlEntry, error) {
 	}(row)
 	result := make([]UrlEntry, 0)
 	for row.Next() {
-		var entry UrlEntry
-		err = row.Scan(&entry.Id, &entry.Url, &entry.ExpireAt)
+		entry, err := scanEntry(row)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, entry)
+		result = append(result, *entry)
+	}
+	return result, nil
+}
+
+func (s *sqliteBackend) AddHitCounts(counts []HitCount) error {
+	return s.changes.own(func() error {
+		return s.addHitCounts(counts)
+	})
+}
+
+func (s *sqliteBackend) addHitCounts(counts []HitCount) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO hit_daily(id, day, count) VALUES (?,?,?)
+			ON CONFLICT(id, day) DO UPDATE SET count = count + excluded.count`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, c := range counts {
+		if _, err = stmt.Exec(c.Id, c.Day, c.Count); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteBackend) QueryHitCounts(id uint64) ([]HitCount, error) {
+	query := `SELECT id, day, count FROM hit_daily WHERE id = ? ORDER BY day`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	row, err := stmt.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		_ = row.Close()
+	}(row)
+	result := make([]HitCount, 0)
+	for row.Next() {
+		var c HitCount
+		if err = row.Scan(&c.Id, &c.Day, &c.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
 	}
 	return result, nil
 }
@@ -131,7 +454,7 @@ func (s *sqliteBackend) count() (int, error) {
 }
 
 func (s *sqliteBackend) QueryById(id uint64) (*UrlEntry, error) {
-	query := `SELECT * FROM url WHERE id = ? AND (expire_at IS NULL OR expire_at > ?)`
+	query := `SELECT ` + urlColumns + ` FROM url WHERE id = ?1 AND (expire_at IS NULL OR expire_at > ?2) AND (visits_left IS NULL OR visits_left > 0) AND (activate_at IS NULL OR activate_at <= ?2)`
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return nil, err
@@ -145,56 +468,78 @@ func (s *sqliteBackend) QueryById(id uint64) (*UrlEntry, error) {
 		_ = row.Close()
 	}(row)
 	for row.Next() {
-		var entry UrlEntry
-		err = row.Scan(&entry.Id, &entry.Url, &entry.ExpireAt)
-		if err != nil {
-			return nil, err
-		}
-		return &entry, nil
+		return scanEntry(row)
 	}
 	return nil, nil
 }
 
-func (s *sqliteBackend) ClearExpired() error {
-	_, _ = s.db.Exec(`DROP TABLE tmp_url`)
+func (s *sqliteBackend) DeleteExpired(limit int) (deleted int64, err error) {
+	err = s.changes.own(func() error {
+		deleted, err = s.deleteExpired(limit)
+		return err
+	})
+	return deleted, err
+}
+
+func (s *sqliteBackend) deleteExpired(limit int) (int64, error) {
 	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if err = createTmpTables(tx); err != nil {
-		return err
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	// the ids are selected once without ordering, so the indexes on expire_at & visits_left are used
+	rows, err := tx.Query(`SELECT id FROM url WHERE (expire_at IS NOT NULL AND expire_at <= ?) OR visits_left <= 0 LIMIT ?`, time.Now().Unix(), limit)
+	if err != nil {
+		return 0, err
 	}
-
-	rows, err := tx.Query(`SELECT * FROM url WHERE expire_at IS NULL OR expire_at > ?`, time.Now().Unix())
-	var entry UrlEntry
+	var ids []any
 	for rows.Next() {
-		err = rows.Scan(&entry.Id, &entry.Url, &entry.ExpireAt)
-		if err != nil {
-			return err
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return 0, err
 		}
-		_, err = tx.Exec(`INSERT INTO tmp_url(id, url, expire_at) VALUES (?,?,?)`, entry.Id, entry.Url, entry.ExpireAt)
-		if err != nil {
-			return err
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	in := `(?` + strings.Repeat(`,?`, len(ids)-1) + `)`
+	for _, table := range []string{"alias", "hit_daily", "url_history"} {
+		if _, err = tx.Exec(`DELETE FROM `+table+` WHERE id IN `+in, ids...); err != nil {
+			return 0, err
 		}
 	}
-	_, err = tx.Exec(`DROP TABLE url`)
+	res, err := tx.Exec(`DELETE FROM url WHERE id IN `+in, ids...)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	_, err = tx.Exec(`ALTER TABLE tmp_url RENAME TO url`)
+	deleted, err := res.RowsAffected()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return tx.Commit()
+	return deleted, tx.Commit()
 }
 
-func createTmpTables(tx *sql.Tx) error {
-	ddl := `CREATE TABLE tmp_url (
-			"id" INTEGER NOT NULL PRIMARY KEY,
-			"url" TEXT NOT NULL,
-			"expire_at" INTEGER);`
-	_, err := tx.Exec(ddl)
-	return err
+func (s *sqliteBackend) Info() (*BackendInfo, error) {
+	nodeId, err := s.getNodeId()
+	if err != nil {
+		return nil, err
+	}
+	info := &BackendInfo{Kind: "sqlite", NodeId: nodeId, SchemaVersion: int(s.version), LatestSchemaVersion: len(sqliteMigrations)}
+	err = s.db.QueryRow(`SELECT COUNT(1),
+			COALESCE(SUM((expire_at IS NOT NULL AND expire_at <= ?) OR visits_left <= 0), 0),
+			COALESCE(SUM(disabled), 0) FROM url`, time.Now().Unix()).Scan(&info.Urls, &info.Expired, &info.Disabled)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`SELECT COUNT(1) FROM alias`).Scan(&info.Aliases)
+	return info, err
 }
 
 func (s *sqliteBackend) Close() error {
@@ -202,20 +547,26 @@ func (s *sqliteBackend) Close() error {
 }
 
 func (s *sqliteBackend) getNodeId() (int64, error) {
-	row, err := s.db.Query(`PRAGMA user_version`)
+	var nodeId int64
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = 'node_id'`).Scan(&nodeId)
+	return nodeId, err
+}
+
+// checkNodeId makes sure the node id in meta is valid and identical to the one in user_version
+func (s *sqliteBackend) checkNodeId() (int64, error) {
+	nodeId, err := s.getNodeId()
 	if err != nil {
 		return 0, err
 	}
-	defer func(row *sql.Rows) {
-		_ = row.Close()
-	}(row)
-	for row.Next() {
-		var userVer int64
-		err = row.Scan(&userVer)
-		if err != nil {
-			return 0, err
-		}
-		return userVer & 0x3f, nil
+	if nodeId < 0 || nodeId > 1023 {
+		return 0, fmt.Errorf("%v in meta is not a valid snowflake node id", nodeId)
+	}
+	legacyNodeId, err := sqliteLegacyNodeId(s.db)
+	if err != nil {
+		return 0, err
+	}
+	if legacyNodeId != nodeId {
+		return 0, fmt.Errorf("inconsistent node id, %d in meta but %d in user_version", nodeId, legacyNodeId)
 	}
-	return 0, nil
+	return nodeId, nil
 }
@@ -0,0 +1,66 @@
+package shorturl
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sqliteChanges tells the writes of a backend itself, e.g. consuming visits,
+// flushing stats or sweeping by the server, from the ones of the other
+// processes by the file change counter in the db header, which is increased
+// by every transaction committed in the rollback journal mode.
+type sqliteChanges struct {
+	filename string
+	mu       sync.Mutex
+	seen     uint32 // the counter of the last change noticed or committed by itself
+}
+
+func newSqliteChanges(filename string) *sqliteChanges {
+	c := &sqliteChanges{filename: filepath.Clean(filename)}
+	c.seen, _ = c.counter()
+	return c
+}
+
+// counter returns false if the counter is unknown, e.g. in the WAL mode which
+// doesn't maintain it
+func (c *sqliteChanges) counter() (uint32, bool) {
+	f, err := os.Open(c.filename)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	header := make([]byte, 28)
+	if _, err = io.ReadFull(f, header); err != nil || header[18] != 1 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(header[24:]), true
+}
+
+// own runs write, the transaction it commits is not reported by changedExternally
+// unless any other one is committed meanwhile
+func (c *sqliteChanges) own(write func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	before, ok := c.counter()
+	err := write()
+	if after, found := c.counter(); ok && found && before == c.seen && after-before <= 1 {
+		c.seen = after
+	}
+	return err
+}
+
+// changedExternally tells if the file has been changed by the others since the last call
+func (c *sqliteChanges) changedExternally() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, ok := c.counter()
+	if !ok {
+		return true
+	}
+	changed := current != c.seen
+	c.seen = current
+	return changed
+}
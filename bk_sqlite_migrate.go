@@ -0,0 +1,205 @@
+package shorturl
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type sqliteMigration func(tx *sql.Tx) error
+
+// schema migrations of the sqlite backend, schema version is the count applied.
+// Never modify the released ones, append new migrations instead.
+var sqliteMigrations = []sqliteMigration{
+	// 1: the initial schema
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS url (
+			"id" INTEGER NOT NULL PRIMARY KEY,
+			"url" TEXT NOT NULL,
+			"expire_at" INTEGER);`)
+		return err
+	},
+	// 2: aliases, hit counts, disabling & history. DBs opened by the builds
+	// before the migrations might have some of them already.
+	func(tx *sql.Tx) error {
+		ddls := []string{
+			`CREATE TABLE IF NOT EXISTS alias (
+			"alias" TEXT NOT NULL PRIMARY KEY,
+			"id" INTEGER NOT NULL);`,
+			`CREATE TABLE IF NOT EXISTS hit_daily (
+			"id" INTEGER NOT NULL,
+			"day" TEXT NOT NULL,
+			"count" INTEGER NOT NULL,
+			PRIMARY KEY ("id", "day"));`,
+			`CREATE TABLE IF NOT EXISTS url_history (
+			"id" INTEGER NOT NULL,
+			"url" TEXT NOT NULL,
+			"expire_at" INTEGER,
+			"changed_at" INTEGER NOT NULL);`,
+			`CREATE INDEX IF NOT EXISTS url_history_id ON url_history ("id");`,
+		}
+		for _, ddl := range ddls {
+			if _, err := tx.Exec(ddl); err != nil {
+				return err
+			}
+		}
+		return sqliteAddColumn(tx, "url", `"disabled" INTEGER NOT NULL DEFAULT 0`)
+	},
+	// 3: per-link redirect status code
+	func(tx *sql.Tx) error {
+		return sqliteAddColumn(tx, "url", `"redirect_code" INTEGER NOT NULL DEFAULT 302`)
+	},
+	// 4: per-link password
+	func(tx *sql.Tx) error {
+		return sqliteAddColumn(tx, "url", `"password_hash" TEXT NOT NULL DEFAULT ''`)
+	},
+	// 5: visit limit
+	func(tx *sql.Tx) error {
+		return sqliteAddColumn(tx, "url", `"visits_left" INTEGER`)
+	},
+	// 6: activation time
+	func(tx *sql.Tx) error {
+		return sqliteAddColumn(tx, "url", `"activate_at" INTEGER`)
+	},
+	// 7: indexes for sweeping the expired & used up links by batches
+	func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS url_expire_at ON url ("expire_at");`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS url_visits_left ON url ("visits_left");`)
+		return err
+	},
+}
+
+func sqliteHasColumn(tx *sql.Tx, table string, column string) (bool, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(1) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	return count > 0, err
+}
+
+// sqliteAddColumn adds the column unless existed, the definition starts with the quoted column name
+func sqliteAddColumn(tx *sql.Tx, table string, definition string) error {
+	name := strings.Trim(strings.Fields(definition)[0], `"`)
+	has, err := sqliteHasColumn(tx, table, name)
+	if err != nil || has {
+		return err
+	}
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + definition)
+	return err
+}
+
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func sqliteHasTable(q rowQueryer, table string) (bool, error) {
+	var count int
+	err := q.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count)
+	return count > 0, err
+}
+
+// sqliteSchemaVersion returns 0 for empty DBs, and 1 for the DBs created
+// before the meta table, whose node id lives in user_version only.
+func sqliteSchemaVersion(db *sql.DB) (int, error) {
+	hasMeta, err := sqliteHasTable(db, "meta")
+	if err != nil {
+		return 0, err
+	}
+	if !hasMeta {
+		hasUrl, err := sqliteHasTable(db, "url")
+		if err != nil || !hasUrl {
+			return 0, err
+		}
+		return 1, nil
+	}
+	var version int
+	err = db.QueryRow(`SELECT value FROM meta WHERE key = 'schema_version'`).Scan(&version)
+	return version, err
+}
+
+// sqliteLegacyNodeId reads the node id kept in user_version, by the DBs before the meta table
+func sqliteLegacyNodeId(q rowQueryer) (int64, error) {
+	var userVer int64
+	if err := q.QueryRow(`PRAGMA user_version`).Scan(&userVer); err != nil {
+		return 0, err
+	}
+	if userVer < 0 || userVer > 1023 {
+		return 0, fmt.Errorf("%v in user_version is not a valid snowflake node id", userVer)
+	}
+	return userVer, nil
+}
+
+// sqliteMigrate upgrades the schema to the latest version, the node id is only
+// used if the DB is empty. Returns the schema version before & after.
+func sqliteMigrate(db *sql.DB, nodeId int64) (int, int, error) {
+	from, err := sqliteSchemaVersion(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > len(sqliteMigrations) {
+		return from, from, fmt.Errorf("db schema version %d is newer than supported %d", from, len(sqliteMigrations))
+	}
+	if from == len(sqliteMigrations) {
+		return from, from, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return from, from, err
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	hasMeta, err := sqliteHasTable(tx, "meta")
+	if err != nil {
+		return from, from, err
+	}
+	if !hasMeta {
+		if from > 0 {
+			if nodeId, err = sqliteLegacyNodeId(tx); err != nil {
+				return from, from, err
+			}
+		}
+		_, err = tx.Exec(`CREATE TABLE meta (
+			"key" TEXT NOT NULL PRIMARY KEY,
+			"value" INTEGER NOT NULL);`)
+		if err != nil {
+			return from, from, err
+		}
+		_, err = tx.Exec(`INSERT INTO meta(key, value) VALUES ('node_id', ?), ('schema_version', ?)`, nodeId, from)
+		if err != nil {
+			return from, from, err
+		}
+	}
+	for version := from; version < len(sqliteMigrations); version++ {
+		if err = sqliteMigrations[version](tx); err != nil {
+			return from, from, fmt.Errorf("failed on migrating to schema version %d: %w", version+1, err)
+		}
+	}
+	if _, err = tx.Exec(`UPDATE meta SET value = ? WHERE key = 'schema_version'`, len(sqliteMigrations)); err != nil {
+		return from, from, err
+	}
+	return from, len(sqliteMigrations), tx.Commit()
+}
+
+// SqliteMigrate upgrades an existing sqlite DB in place, returns the schema version before & after
+func SqliteMigrate(filename string) (int, int, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return 0, 0, err
+	}
+	db, err := sql.Open("sqlite3", sqliteDsn(filename))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	version, err := sqliteSchemaVersion(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	if version == 0 {
+		return 0, 0, fmt.Errorf("%s is not a shorturl db", filename)
+	}
+	return sqliteMigrate(db, 0)
+}
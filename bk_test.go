@@ -0,0 +1,550 @@
+package shorturl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/bwmarrin/snowflake"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBackend checks the common behaviours every Backend implementation should have
+func testBackend(t *testing.T, bk Backend) {
+	nodeId, err := bk.getNodeId()
+	if err != nil {
+		t.Fatal("failed on getting node id.", err)
+	}
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	id, err := mgr.InsertOrReuse("https://test.mrzm.io/bk1", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if id.Node() != nodeId {
+		t.Fatal("node id not match")
+	}
+	if info, err := mgr.Info(); err != nil || info.NodeId != nodeId || info.Urls < 1 {
+		t.Fatal("info not match.", info, err)
+	}
+	reused, err := mgr.InsertOrReuse("https://test.mrzm.io/bk1", -1)
+	if err != nil || reused != id {
+		t.Fatal("should reuse id.", err)
+	}
+	expiring := &UrlEntry{Id: uint64(id) + 1, Url: "https://test.mrzm.io/bk2", ExpireAt: sql.NullInt64{Int64: time.Now().Unix() - 1, Valid: true}}
+	if err = bk.InsertUrl(expiring); err != nil {
+		t.Fatal("failed on inserting expired entry.", err)
+	}
+	if entry, err := bk.QueryById(expiring.Id); err != nil || entry != nil {
+		t.Fatal("expired entry should not be found.", err)
+	}
+	if entries, err := bk.QueryByUrl(expiring.Url); err != nil || len(entries) != 0 {
+		t.Fatal("expired entry should not be found by url.", err)
+	}
+
+	if err = mgr.ReserveAlias("bk-alias", id); err != nil {
+		t.Fatal("failed on reserving alias.", err)
+	}
+	if aliased, err := bk.QueryAlias("bk-alias"); err != nil || aliased != uint64(id) {
+		t.Fatal("alias not match.", err)
+	}
+	if aliased, err := bk.QueryAlias("bk-none"); err != nil || aliased != 0 {
+		t.Fatal("alias should not exist.", err)
+	}
+
+	protected, err := mgr.InsertOrReuseWithOptions("https://test.mrzm.io/bk4", LinkOptions{ExpireAt: -1, Password: "s3cret"})
+	if err != nil {
+		t.Fatal("failed on inserting protected link.", err)
+	}
+	if entry, err := bk.QueryById(uint64(protected)); err != nil || entry == nil || !verifyPassword(entry.PasswordHash, "s3cret") {
+		t.Fatal("password hash not kept.", err)
+	}
+
+	pending, err := mgr.InsertOrReuseWithOptions("https://test.mrzm.io/bk6", LinkOptions{ExpireAt: -1, ActivateAt: time.Now().Unix() + 3600})
+	if err != nil {
+		t.Fatal("failed on inserting pending link.", err)
+	}
+	if entry, err := bk.QueryById(uint64(pending)); err != nil || entry != nil {
+		t.Fatal("pending link should not be found.", err)
+	}
+	if entries, err := bk.QueryByUrl("https://test.mrzm.io/bk6"); err != nil || len(entries) != 0 {
+		t.Fatal("pending link should not be found by url.", err)
+	}
+	if entry, err := bk.QueryPending(uint64(pending)); err != nil || entry == nil || entry.ActivateAt.Int64 <= time.Now().Unix() {
+		t.Fatal("pending link not found.", err)
+	}
+	if entry, err := mgr.Query(pending); err != nil || entry == nil {
+		t.Fatal("manager should find pending link.", err)
+	}
+	if entry, err := bk.QueryPending(uint64(id)); err != nil || entry != nil {
+		t.Fatal("active link should not be pending.", err)
+	}
+
+	limited, err := mgr.InsertOrReuseWithOptions("https://test.mrzm.io/bk5", LinkOptions{ExpireAt: -1, MaxVisits: 5})
+	if err != nil {
+		t.Fatal("failed on inserting limited link.", err)
+	}
+	var consumed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := bk.ConsumeVisit(uint64(limited)); err != nil {
+				t.Error("failed on consuming visit.", err)
+			} else if ok {
+				consumed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed.Load() != 5 {
+		t.Fatal("visits consumed not match", consumed.Load())
+	}
+	if entry, err := bk.QueryById(uint64(limited)); err != nil || entry != nil {
+		t.Fatal("used up link should be expired.", err)
+	}
+	if ok, err := bk.ConsumeVisit(uint64(id)); err != nil || ok {
+		t.Fatal("unlimited link should not be consumed.", err)
+	}
+
+	if err = mgr.Disable(id); err != nil {
+		t.Fatal("failed on disable.", err)
+	}
+	if entry, err := bk.QueryById(uint64(id)); err != nil || entry == nil || !entry.Disabled {
+		t.Fatal("should be disabled.", err)
+	}
+	listIds := func(filter LinkFilter) []snowflake.ID {
+		filter.MinId = uint64(id)
+		entries, err := bk.ListUrls(filter)
+		if err != nil {
+			t.Fatal("failed on listing.", err)
+		}
+		ids := make([]snowflake.ID, len(entries))
+		for i, entry := range entries {
+			ids[i] = snowflake.ID(entry.Id)
+		}
+		return ids
+	}
+	for _, c := range []struct {
+		filter   LinkFilter
+		expected []snowflake.ID
+	}{
+		{LinkFilter{}, []snowflake.ID{limited, pending, protected, id + 1, id}},
+		{LinkFilter{State: ActiveState}, []snowflake.ID{protected}},
+		{LinkFilter{State: ExpiredState}, []snowflake.ID{limited, id + 1}},
+		{LinkFilter{State: DisabledState}, []snowflake.ID{id}},
+		{LinkFilter{State: PendingState}, []snowflake.ID{pending}},
+		{LinkFilter{Contains: "/bk4"}, []snowflake.ID{protected}},
+		{LinkFilter{Contains: "mrzm.io/bk", Limit: 2}, []snowflake.ID{limited, pending}},
+		{LinkFilter{Contains: "mrzm.io/bk", Limit: 2, MaxId: uint64(pending)}, []snowflake.ID{protected, id + 1}},
+		{LinkFilter{MaxId: uint64(id)}, []snowflake.ID{}},
+	} {
+		if ids := listIds(c.filter); fmt.Sprint(ids) != fmt.Sprint(c.expected) {
+			t.Fatal("listed links not match.", c.filter, ids)
+		}
+	}
+	if entries, err := bk.QueryByUrl("https://test.mrzm.io/bk1"); err != nil || len(entries) != 0 {
+		t.Fatal("disabled entry should not be reused.", err)
+	}
+	if err = mgr.Enable(id); err != nil {
+		t.Fatal("failed on enable.", err)
+	}
+
+	day := time.Now().UTC().Format(hitDayLayout)
+	if err = bk.AddHitCounts([]HitCount{{uint64(id), day, 2}}); err != nil {
+		t.Fatal("failed on adding hit counts.", err)
+	}
+	if err = bk.AddHitCounts([]HitCount{{uint64(id), day, 3}}); err != nil {
+		t.Fatal("failed on adding hit counts.", err)
+	}
+	if counts, err := mgr.Stats(id); err != nil || len(counts) != 1 || counts[0].Count != 5 {
+		t.Fatal("hit counts not match.", counts, err)
+	}
+
+	if err = mgr.Retarget(id, "https://test.mrzm.io/bk3"); err != nil {
+		t.Fatal("failed on retarget.", err)
+	}
+	if history, err := mgr.History(id); err != nil || len(history) != 1 || history[0].Url != "https://test.mrzm.io/bk1" {
+		t.Fatal("history not match.", history, err)
+	}
+	if entry, err := bk.QueryById(uint64(id)); err != nil || entry == nil || entry.Url != "https://test.mrzm.io/bk3" {
+		t.Fatal("should be retargeted.", err)
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		entry := &UrlEntry{Id: uint64(id) - i, Url: "https://test.mrzm.io/bk-sweep", ExpireAt: sql.NullInt64{Int64: time.Now().Unix() - 1, Valid: true}}
+		if err = bk.InsertUrl(entry); err != nil {
+			t.Fatal("failed on inserting expired entry.", err)
+		}
+	}
+	if err = bk.InsertAlias("bk-expired", uint64(id)-1); err != nil {
+		t.Fatal("failed on reserving alias.", err)
+	}
+	if deleted, err := bk.DeleteExpired(2); err != nil || deleted != 2 {
+		t.Fatal("should delete a batch.", deleted, err)
+	}
+	// bk2, used up bk5 & the rest of bk-sweep
+	if deleted, err := mgr.Sweep(); err != nil || deleted != 3 {
+		t.Fatal("should delete the rest.", deleted, err)
+	}
+	if aliased, err := bk.QueryAlias("bk-expired"); err != nil || aliased != 0 {
+		t.Fatal("alias of the expired link should be deleted.", err)
+	}
+	if err = mgr.Clean(); err != nil {
+		t.Fatal("failed on clean.", err)
+	}
+	if entry, err := bk.QueryById(uint64(id)); err != nil || entry == nil {
+		t.Fatal("should survive cleaning.", err)
+	}
+
+	if err = mgr.Delete(id); err != nil {
+		t.Fatal("failed on delete.", err)
+	}
+	if entry, err := bk.QueryById(uint64(id)); err != nil || entry != nil {
+		t.Fatal("should be deleted.", err)
+	}
+	if aliased, err := bk.QueryAlias("bk-alias"); err != nil || aliased != 0 {
+		t.Fatal("alias should be deleted.", err)
+	}
+}
+
+func TestSqliteBackend(t *testing.T) {
+	bk := createBk(t)
+	defer bk.Close()
+	testBackend(t, bk)
+}
+
+// runs only if SURL_TEST_PG_DSN points to a disposable postgres database
+func TestPostgresBackend(t *testing.T) {
+	dsn := os.Getenv("SURL_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("SURL_TEST_PG_DSN not set")
+	}
+	bk, err := PostgresOpen(dsn, true, 3)
+	if err != nil {
+		t.Fatal("failed on opening postgres.", err)
+	}
+	defer bk.Close()
+	testBackend(t, bk)
+
+	if _, err = PostgresOpen(dsn, true, 4); err == nil {
+		t.Fatal("should fail on node id mismatch")
+	}
+	reader, err := PostgresOpen(dsn, false, 0)
+	if err != nil {
+		t.Fatal("failed on opening postgres as reader.", err)
+	}
+	defer reader.Close()
+	if nodeId, _ := reader.getNodeId(); nodeId != 3 {
+		t.Fatal("node id not match")
+	}
+	if from, to, err := PostgresMigrate(dsn); err != nil || from != to || to != len(pgMigrations) {
+		t.Fatal("should be up to date already.", from, to, err)
+	}
+}
+
+// the queries of postgres are built without a database, unlike the ones run by TestPostgresBackend
+func TestPostgresQueries(t *testing.T) {
+	query, args := listUrlsQuery(&LinkFilter{State: ActiveState, MinId: 1, MaxId: 9, Contains: "mrzm", Limit: 5}, 100, pgParam, pgContains)
+	expected := `SELECT ` + urlColumns + ` FROM url WHERE id >= $2 AND id < $3 AND strpos(url, $4) > 0 AND ` +
+		`(expire_at IS NULL OR expire_at > $1) AND (visits_left IS NULL OR visits_left > 0) AND NOT disabled AND ` +
+		`(activate_at IS NULL OR activate_at <= $1) ORDER BY id DESC LIMIT $5`
+	if query != expected || !reflect.DeepEqual(args, []any{int64(100), int64(1), int64(9), "mrzm", 5}) {
+		t.Error("list query not match", query, args)
+	}
+	query, args = listUrlsQuery(&LinkFilter{State: ExpiredState}, 100, pgParam, pgContains)
+	expected = `SELECT ` + urlColumns + ` FROM url WHERE id >= $2 AND ` +
+		`NOT ((expire_at IS NULL OR expire_at > $1) AND (visits_left IS NULL OR visits_left > 0)) ORDER BY id DESC`
+	if query != expected || len(args) != 2 {
+		t.Error("list query not match", query, args)
+	}
+
+	dst, expireAt, code := "https://test.mrzm.io/pg", int64(0), 308
+	query, args = updateLinkQuery(&LinkUpdate{Url: &dst, ExpireAt: &expireAt, RedirectCode: &code}, 7, pgParam)
+	if query != `UPDATE url SET url = $1, expire_at = $2, redirect_code = $3 WHERE id = $4` ||
+		!reflect.DeepEqual(args, []any{dst, sql.NullInt64{}, 308, int64(7)}) {
+		t.Error("update query not match", query, args)
+	}
+	query, args = updateLinkQuery(&LinkUpdate{RedirectCode: &code}, 7, pgParam)
+	if query != `UPDATE url SET redirect_code = $1 WHERE id = $2` || len(args) != 2 {
+		t.Error("update query not match", query, args)
+	}
+	if query, _ = updateLinkQuery(&LinkUpdate{}, 7, pgParam); query != "" {
+		t.Error("nothing to update", query)
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	bk, err := MemoryOpen(5)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	testBackend(t, bk)
+	if _, err = MemoryOpen(1024); err == nil {
+		t.Fatal("should fail on invalid node id")
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	bk, err := MemoryOpen(6)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	for i := uint64(1); i <= 7; i++ {
+		entry := &UrlEntry{Id: i, Url: "https://test.mrzm.io/sweep", ExpireAt: sql.NullInt64{Int64: time.Now().Unix() - 1, Valid: true}}
+		if err = bk.InsertUrl(entry); err != nil {
+			t.Fatal("failed on inserting expired entry.", err)
+		}
+	}
+	if err = bk.InsertUrl(&UrlEntry{Id: 8, Url: "https://test.mrzm.io/sweep"}); err != nil {
+		t.Fatal("failed on inserting entry.", err)
+	}
+	sweeper := NewSweeper(func(fn func(bk Backend)) {
+		fn(bk)
+	}, 10*time.Millisecond, 3)
+	defer sweeper.Close()
+	for i := 0; i < 100; i++ {
+		if info, err := bk.Info(); err != nil || info.Urls == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, err := bk.Info(); err != nil || info.Urls != 1 || info.Expired != 0 {
+		t.Fatal("expired links should be swept.", info, err)
+	}
+}
+
+func createLegacyDb(t *testing.T, userVersion int64) string {
+	filename := t.TempDir() + "/legacy.db"
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal("failed on creating legacy db.", err)
+	}
+	defer db.Close()
+	stmts := []string{
+		fmt.Sprintf("PRAGMA user_version = %d", userVersion),
+		`CREATE TABLE url (
+			"id" INTEGER NOT NULL PRIMARY KEY,
+			"url" TEXT NOT NULL,
+			"expire_at" INTEGER);`,
+		`INSERT INTO url(id, url, expire_at) VALUES (42, 'https://test.mrzm.io/legacy', NULL)`,
+	}
+	for _, stmt := range stmts {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal("failed on creating legacy db.", err)
+		}
+	}
+	return filename
+}
+
+func TestSqliteMigrate(t *testing.T) {
+	filename := createLegacyDb(t, 2)
+	if _, err := SqliteOpen(filename, false, 0); err == nil {
+		t.Fatal("should refuse outdated db")
+	}
+	from, to, err := SqliteMigrate(filename)
+	if err != nil {
+		t.Fatal("failed on migrating.", err)
+	}
+	if from != 1 || to != len(sqliteMigrations) {
+		t.Fatal("versions not match", from, to)
+	}
+	if from, to, err = SqliteMigrate(filename); err != nil || from != to {
+		t.Fatal("migrating again should be noop.", err)
+	}
+	bk, err := SqliteOpen(filename, true, 2)
+	if err != nil {
+		t.Fatal("failed on opening migrated db.", err)
+	}
+	entry, err := bk.QueryById(42)
+	if err != nil || entry == nil || entry.Url != "https://test.mrzm.io/legacy" || entry.Disabled {
+		t.Fatal("legacy entry not kept.", err)
+	}
+	testBackend(t, bk)
+	plan, err := bk.db.Query(`EXPLAIN QUERY PLAN SELECT id FROM url WHERE (expire_at IS NOT NULL AND expire_at <= 1) OR visits_left <= 0 LIMIT 10`)
+	if err != nil {
+		t.Fatal("failed on explaining.", err)
+	}
+	var details []string
+	for plan.Next() {
+		var id, parent, unused int
+		var detail string
+		if err = plan.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal("failed on scanning plan.", err)
+		}
+		details = append(details, detail)
+	}
+	if joined := strings.Join(details, "\n"); !strings.Contains(joined, "url_expire_at") || !strings.Contains(joined, "url_visits_left") {
+		t.Fatal("sweeping should use the indexes.", joined)
+	}
+
+	if _, err = bk.db.Exec(`UPDATE meta SET value = 99 WHERE key = 'schema_version'`); err != nil {
+		t.Fatal("failed on updating schema version.", err)
+	}
+	_ = bk.Close()
+	if _, err = SqliteOpen(filename, false, 0); err == nil {
+		t.Fatal("should refuse newer db")
+	}
+	if _, _, err = SqliteMigrate(filename); err == nil {
+		t.Fatal("should refuse migrating newer db")
+	}
+
+	if _, _, err = SqliteMigrate(t.TempDir() + "/nothing.db"); err == nil {
+		t.Fatal("should fail on nonexistent db")
+	}
+}
+
+func TestSqliteNodeId(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, nodeId := range []int64{0, 64, 1023} {
+		filename := fmt.Sprintf("%s/node-%d.db", dir, nodeId)
+		bk, err := SqliteOpen(filename, true, nodeId)
+		if err != nil {
+			t.Fatal("failed on creating db.", err)
+		}
+		if got, err := bk.getNodeId(); err != nil || got != nodeId {
+			t.Fatal("node id not match", nodeId, got, err)
+		}
+		_ = bk.Close()
+		files = append(files, filename)
+	}
+	redirecter, err := NewRedirecter(files, "https://r.mrzm.io", false, false)
+	if err != nil {
+		t.Fatal("nodes beyond 64 should not be duplicated.", err)
+	}
+	if len(redirecter.bks) != 3 {
+		t.Fatal("should have 3 nodes")
+	}
+
+	// legacy DB with node id >= 64
+	filename := createLegacyDb(t, 100)
+	if _, _, err = SqliteMigrate(filename); err != nil {
+		t.Fatal("failed on migrating.", err)
+	}
+	bk, err := SqliteOpen(filename, true, 100)
+	if err != nil {
+		t.Fatal("failed on opening migrated db.", err)
+	}
+	info, err := bk.Info()
+	if err != nil {
+		t.Fatal("failed on info.", err)
+	}
+	if info.NodeId != 100 || info.Urls != 1 || info.SchemaVersion != len(sqliteMigrations) {
+		t.Fatal("info not match", info)
+	}
+
+	// inconsistent node id
+	if _, err = bk.db.Exec(`UPDATE meta SET value = 7 WHERE key = 'node_id'`); err != nil {
+		t.Fatal("failed on updating meta.", err)
+	}
+	_ = bk.Close()
+	if _, err = SqliteOpen(filename, false, 0); err == nil {
+		t.Fatal("should refuse inconsistent node id")
+	}
+}
+
+func TestSqliteBackend_OwnChanges(t *testing.T) {
+	bk := createBk(t)
+	defer bk.Close()
+	redirecter, err := NewRedirecterWithBackends([]Backend{bk}, "https://r.mrzm.io/own", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	id := snowflake.ID(1 << 22)
+	if err = bk.InsertUrl(&UrlEntry{Id: uint64(id), Url: "https://example.mrzm.io/own", VisitsLeft: sql.NullInt64{Int64: 5, Valid: true}}); err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if !redirecter.modifiedExternally(bk.changes.filename) || redirecter.modifiedExternally(bk.changes.filename) {
+		t.Fatal("should report the insert once")
+	}
+
+	// the writes of the server itself
+	if consumed, err := bk.ConsumeVisit(uint64(id)); err != nil || !consumed {
+		t.Fatal("failed on consuming a visit.", err)
+	}
+	if err = bk.AddHitCounts([]HitCount{{uint64(id), "2024-01-02", 1}}); err != nil {
+		t.Fatal("failed on adding hit counts.", err)
+	}
+	if _, err = bk.DeleteExpired(10); err != nil {
+		t.Fatal("failed on deleting expired.", err)
+	}
+	if redirecter.modifiedExternally(bk.changes.filename) {
+		t.Fatal("own writes should not be reported")
+	}
+
+	other, err := SqliteOpen(bk.changes.filename, true, 0)
+	if err != nil {
+		t.Fatal("failed on opening db.", err)
+	}
+	defer other.Close()
+	if err = other.SetDisabled(uint64(id), true); err != nil {
+		t.Fatal("failed on disabling.", err)
+	}
+	if _, err = bk.ConsumeVisit(uint64(id)); err != nil {
+		t.Fatal("failed on consuming a visit.", err)
+	}
+	if !redirecter.modifiedExternally(bk.changes.filename) {
+		t.Fatal("writes of the others should be reported")
+	}
+	if !redirecter.modifiedExternally("/not/served.db") {
+		t.Fatal("files not served should be reported")
+	}
+}
+
+// holdWriteLock keeps the db locked for writing by another connection for d
+func holdWriteLock(t *testing.T, filename string, d time.Duration) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal("failed on opening db.", err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal("failed on connecting db.", err)
+	}
+	if _, err = conn.ExecContext(context.Background(), `BEGIN IMMEDIATE`); err != nil {
+		t.Fatal("failed on locking db.", err)
+	}
+	go func() {
+		time.Sleep(d)
+		_, _ = conn.ExecContext(context.Background(), `COMMIT`)
+		_ = conn.Close()
+		_ = db.Close()
+	}()
+}
+
+func TestSqliteBackend_DeleteExpiredWhileLocked(t *testing.T) {
+	bk := createBk(t)
+	defer bk.Close()
+	if err := bk.InsertUrl(&UrlEntry{Id: 1 << 22, Url: "https://example.mrzm.io/locked", ExpireAt: sql.NullInt64{Int64: 1, Valid: true}}); err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	holdWriteLock(t, bk.changes.filename, 200*time.Millisecond)
+	if deleted, err := bk.DeleteExpired(10); err != nil || deleted != 1 {
+		t.Fatal("should wait for the lock of the other writer", deleted, err)
+	}
+}
+
+func TestSqliteBackend_UpdateLinkWhileLocked(t *testing.T) {
+	bk := createBk(t)
+	defer bk.Close()
+	if err := bk.InsertUrl(&UrlEntry{Id: 1 << 22, Url: "https://example.mrzm.io/locked"}); err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	holdWriteLock(t, bk.changes.filename, 200*time.Millisecond)
+	dst := "https://example.mrzm.io/moved"
+	if err := bk.UpdateLink(1<<22, &LinkUpdate{Url: &dst}); err != nil {
+		t.Fatal("should wait for the lock of the other writer", err)
+	}
+	if history, err := bk.QueryHistory(1 << 22); err != nil || len(history) != 1 {
+		t.Fatal("previous url should be kept", history, err)
+	}
+}
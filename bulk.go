@@ -0,0 +1,212 @@
+package shorturl
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/snowflake"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	BulkCsv   = "csv"
+	BulkJsonl = "jsonl"
+)
+
+// BulkRecord is a link in an import/export file. Id is the Base58 code,
+// optional when importing; ExpireAt <= 0 means never expire; PasswordHash
+// is in the format of HashPassword; VisitsLeft <= 0 means unlimited;
+// ActivateAt <= 0 means active immediately; a Disabled link responds 410.
+type BulkRecord struct {
+	Line         int    `json:"-"`
+	Id           string `json:"id,omitempty"`
+	Url          string `json:"url"`
+	ExpireAt     int64  `json:"expire_at,omitempty"`
+	RedirectCode int    `json:"redirect_code,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	VisitsLeft   int64  `json:"visits_left,omitempty"`
+	ActivateAt   int64  `json:"activate_at,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+}
+
+// BulkFormat guesses the format by the file extension if format is empty
+func BulkFormat(format string, filename string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch format {
+	case BulkCsv:
+		return BulkCsv, nil
+	case BulkJsonl, "ndjson":
+		return BulkJsonl, nil
+	}
+	return "", fmt.Errorf("unknown bulk format %q, csv or jsonl expected", format)
+}
+
+// ReadBulk calls fn for each record in r. Malformed lines are passed to
+// onError with the line number and skipped, errors returned by fn abort.
+func ReadBulk(r io.Reader, format string, fn func(rec *BulkRecord) error, onError func(line int, err error)) error {
+	switch format {
+	case BulkCsv:
+		return readBulkCsv(r, fn, onError)
+	case BulkJsonl:
+		return readBulkJsonl(r, fn, onError)
+	}
+	return fmt.Errorf("unknown bulk format %q", format)
+}
+
+// the header is required, the columns other than id, url, expire_at, redirect_code, password_hash, visits_left, activate_at & disabled are ignored
+func readBulkCsv(r io.Reader, fn func(rec *BulkRecord) error, onError func(line int, err error)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed on reading csv header: %w", err)
+	}
+	columns := map[string]int{"id": -1, "url": -1, "expire_at": -1, "redirect_code": -1, "password_hash": -1, "visits_left": -1, "activate_at": -1, "disabled": -1}
+	for i, name := range header {
+		if _, ok := columns[strings.TrimSpace(name)]; ok {
+			columns[strings.TrimSpace(name)] = i
+		}
+	}
+	if columns["url"] < 0 {
+		return fmt.Errorf("url column not found in csv header")
+	}
+	field := func(row []string, name string) string {
+		if i := columns[name]; i >= 0 && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				onError(perr.StartLine, err)
+				continue
+			}
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		rec := &BulkRecord{Line: line, Id: field(row, "id"), Url: field(row, "url"), PasswordHash: field(row, "password_hash")}
+		if expireAt := field(row, "expire_at"); expireAt != "" {
+			if rec.ExpireAt, err = strconv.ParseInt(expireAt, 10, 64); err != nil {
+				onError(line, fmt.Errorf("invalid expire_at %q", expireAt))
+				continue
+			}
+		}
+		if code := field(row, "redirect_code"); code != "" {
+			if rec.RedirectCode, err = strconv.Atoi(code); err != nil {
+				onError(line, fmt.Errorf("invalid redirect_code %q", code))
+				continue
+			}
+		}
+		if visits := field(row, "visits_left"); visits != "" {
+			if rec.VisitsLeft, err = strconv.ParseInt(visits, 10, 64); err != nil {
+				onError(line, fmt.Errorf("invalid visits_left %q", visits))
+				continue
+			}
+		}
+		if activateAt := field(row, "activate_at"); activateAt != "" {
+			if rec.ActivateAt, err = strconv.ParseInt(activateAt, 10, 64); err != nil {
+				onError(line, fmt.Errorf("invalid activate_at %q", activateAt))
+				continue
+			}
+		}
+		if disabled := field(row, "disabled"); disabled != "" {
+			if rec.Disabled, err = strconv.ParseBool(disabled); err != nil {
+				onError(line, fmt.Errorf("invalid disabled %q", disabled))
+				continue
+			}
+		}
+		if err = fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func readBulkJsonl(r io.Reader, fn func(rec *BulkRecord) error, onError func(line int, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		rec := &BulkRecord{}
+		if err := json.Unmarshal([]byte(text), rec); err != nil {
+			onError(line, err)
+			continue
+		}
+		rec.Line = line
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+type BulkWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+	w    *bufio.Writer
+}
+
+func NewBulkWriter(w io.Writer, format string) (*BulkWriter, error) {
+	bw := &BulkWriter{w: bufio.NewWriter(w)}
+	switch format {
+	case BulkCsv:
+		bw.csv = csv.NewWriter(bw.w)
+		if err := bw.csv.Write([]string{"id", "url", "expire_at", "redirect_code", "password_hash", "visits_left", "activate_at", "disabled"}); err != nil {
+			return nil, err
+		}
+	case BulkJsonl:
+		bw.json = json.NewEncoder(bw.w)
+	default:
+		return nil, fmt.Errorf("unknown bulk format %q", format)
+	}
+	return bw, nil
+}
+
+func (bw *BulkWriter) Write(entry *UrlEntry) error {
+	rec := BulkRecord{Id: snowflake.ID(entry.Id).Base58(), Url: entry.Url, RedirectCode: entry.RedirectCode, PasswordHash: entry.PasswordHash, VisitsLeft: entry.VisitsLeft.Int64, ActivateAt: entry.ActivateAt.Int64, Disabled: entry.Disabled}
+	if entry.ExpireAt.Valid {
+		rec.ExpireAt = entry.ExpireAt.Int64
+	}
+	if bw.csv != nil {
+		expireAt, visitsLeft, activateAt, disabled := "", "", "", ""
+		if rec.ExpireAt > 0 {
+			expireAt = strconv.FormatInt(rec.ExpireAt, 10)
+		}
+		if entry.VisitsLeft.Valid {
+			visitsLeft = strconv.FormatInt(rec.VisitsLeft, 10)
+		}
+		if rec.ActivateAt > 0 {
+			activateAt = strconv.FormatInt(rec.ActivateAt, 10)
+		}
+		if rec.Disabled {
+			disabled = "true"
+		}
+		return bw.csv.Write([]string{rec.Id, rec.Url, expireAt, strconv.Itoa(rec.RedirectCode), rec.PasswordHash, visitsLeft, activateAt, disabled})
+	}
+	return bw.json.Encode(rec)
+}
+
+func (bw *BulkWriter) Flush() error {
+	if bw.csv != nil {
+		bw.csv.Flush()
+		if err := bw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return bw.w.Flush()
+}
@@ -0,0 +1,171 @@
+package shorturl
+
+import (
+	"container/list"
+	"github.com/patrickmn/go-cache"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCacheTtl    = 5 * time.Minute
+	defaultNegativeTtl = 5 * time.Minute
+)
+
+// LinkCache caches the links by the codes requested, incl. the aliases. A nil
+// entry caches the code as not found.
+type LinkCache interface {
+	Get(code string) (entry *UrlEntry, found bool)
+	// Set caches the entry for ttl, which is always positive
+	Set(code string, entry *UrlEntry, ttl time.Duration)
+	Delete(code string)
+	// DeleteId drops the entries of the link, incl. the ones cached by aliases
+	DeleteId(id uint64)
+	Flush()
+	Stats() CacheStats
+}
+
+type CacheStats struct {
+	Hits      int64
+	Misses    int64 // incl. the expired ones
+	Evictions int64 // dropped for the size limit before expiring
+	Entries   int
+}
+
+// goCache is unbounded, the expired entries are dropped periodically
+type goCache struct {
+	c      *cache.Cache
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func NewGoCache(cleanupInterval time.Duration) LinkCache {
+	return &goCache{c: cache.New(defaultCacheTtl, cleanupInterval)}
+}
+
+func (g *goCache) Get(code string) (*UrlEntry, bool) {
+	cached, found := g.c.Get(code)
+	if !found {
+		g.misses.Add(1)
+		return nil, false
+	}
+	g.hits.Add(1)
+	return cached.(*UrlEntry), true
+}
+
+func (g *goCache) Set(code string, entry *UrlEntry, ttl time.Duration) {
+	g.c.Set(code, entry, max(ttl, time.Millisecond)) // go-cache never expires the ones with negative ttl
+}
+
+func (g *goCache) Delete(code string) {
+	g.c.Delete(code)
+}
+
+func (g *goCache) DeleteId(id uint64) {
+	for k, item := range g.c.Items() {
+		if entry := item.Object.(*UrlEntry); entry != nil && entry.Id == id {
+			g.c.Delete(k)
+		}
+	}
+}
+
+func (g *goCache) Flush() {
+	g.c.Flush()
+}
+
+func (g *goCache) Stats() CacheStats {
+	return CacheStats{Hits: g.hits.Load(), Misses: g.misses.Load(), Entries: g.c.ItemCount()}
+}
+
+// lruCache holds at most size entries, evicting the least recently used ones
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // of *lruItem, the most recently used first
+	stats CacheStats
+}
+
+type lruItem struct {
+	code     string
+	entry    *UrlEntry
+	expireAt time.Time
+}
+
+func NewLruCache(size int) LinkCache {
+	return &lruCache{size: max(size, 1), items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (l *lruCache) Get(code string) (*UrlEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.items[code]
+	if !ok {
+		l.stats.Misses++
+		return nil, false
+	}
+	item := elem.Value.(*lruItem)
+	if !time.Now().Before(item.expireAt) {
+		l.removeLocked(elem)
+		l.stats.Misses++
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	l.stats.Hits++
+	return item.entry, true
+}
+
+func (l *lruCache) Set(code string, entry *UrlEntry, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	item := &lruItem{code, entry, time.Now().Add(ttl)}
+	if elem, ok := l.items[code]; ok {
+		elem.Value = item
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.items[code] = l.order.PushFront(item)
+	for l.order.Len() > l.size {
+		l.removeLocked(l.order.Back())
+		l.stats.Evictions++
+	}
+}
+
+func (l *lruCache) removeLocked(elem *list.Element) {
+	l.order.Remove(elem)
+	delete(l.items, elem.Value.(*lruItem).code)
+}
+
+func (l *lruCache) Delete(code string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[code]; ok {
+		l.removeLocked(elem)
+	}
+}
+
+func (l *lruCache) DeleteId(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, elem := range l.items {
+		if entry := elem.Value.(*lruItem).entry; entry != nil && entry.Id == id {
+			l.removeLocked(elem)
+		}
+	}
+}
+
+func (l *lruCache) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.items = make(map[string]*list.Element)
+	l.order.Init()
+}
+
+func (l *lruCache) Stats() CacheStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Entries = len(l.items)
+	return stats
+}
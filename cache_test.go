@@ -0,0 +1,111 @@
+package shorturl
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testLinkCache(t *testing.T, c LinkCache) {
+	entry := &UrlEntry{Id: 42, Url: "https://test.mrzm.io/cache"}
+	c.Set("code", entry, time.Hour)
+	c.Set("alias", entry, time.Hour)
+	c.Set("gone", nil, time.Hour)
+	c.Set("short", entry, 10*time.Millisecond)
+	if cached, found := c.Get("code"); !found || cached != entry {
+		t.Fatal("should be cached")
+	}
+	if cached, found := c.Get("gone"); !found || cached != nil {
+		t.Fatal("should be cached as not found")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, found := c.Get("short"); found {
+		t.Fatal("should be expired")
+	}
+	c.DeleteId(42)
+	if _, found := c.Get("alias"); found {
+		t.Fatal("should be deleted by id")
+	}
+	if _, found := c.Get("gone"); !found {
+		t.Fatal("the ones not found should be kept")
+	}
+	c.Flush()
+	if _, found := c.Get("gone"); found {
+		t.Fatal("should be flushed")
+	}
+	if stats := c.Stats(); stats.Hits != 3 || stats.Misses != 3 || stats.Entries != 0 {
+		t.Fatal("stats not match", stats)
+	}
+}
+
+func TestGoCache(t *testing.T) {
+	testLinkCache(t, NewGoCache(time.Minute))
+}
+
+func TestLruCache(t *testing.T) {
+	testLinkCache(t, NewLruCache(10))
+
+	c := NewLruCache(2)
+	for _, code := range []string{"a", "b"} {
+		c.Set(code, &UrlEntry{Url: code}, time.Hour)
+	}
+	c.Get("a")
+	c.Set("c", nil, time.Hour) // evicts b, the least recently used
+	if _, found := c.Get("b"); found {
+		t.Fatal("should be evicted")
+	}
+	if _, found := c.Get("a"); !found {
+		t.Fatal("should be kept")
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatal("stats not match", stats)
+	}
+}
+
+type countingRecorder struct {
+	hits atomic.Int64
+}
+
+func (c *countingRecorder) Record(*Hit) {
+	c.hits.Add(1)
+}
+
+func (c *countingRecorder) Close() error {
+	return nil
+}
+
+func TestRedirecter_CacheHit(t *testing.T) {
+	for _, c := range []LinkCache{NewGoCache(time.Minute), NewLruCache(16)} {
+		redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/cache", 0)
+		dst := "https://example.mrzm.io/" + randStr(18)
+		id, err := mgr.InsertOrReuse(dst, -1)
+		if err != nil {
+			t.Fatal("failed on insert.", err)
+		}
+		redirecter.SetCache(c, time.Minute, time.Minute)
+		recorder := &countingRecorder{}
+		redirecter.SetHitRecorder(recorder)
+		check302("GET", "https://r.mrzm.io/cache/"+id.Base58(), dst, redirecter, t)
+		check404("GET", "https://r.mrzm.io/cache/nothing", redirecter, t)
+
+		// served from the cache only, the backend is not queried again
+		if err = mgr.bk.Delete(uint64(id)); err != nil {
+			t.Fatal("failed on delete.", err)
+		}
+		rr := httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, httptest.NewRequest("GET", "https://r.mrzm.io/cache/"+id.Base58(), nil))
+		if rr.Code != 302 || rr.Header().Get("Location") != dst || rr.Body.String() != "<a href=\""+dst+"\">Found</a>.\n\n" {
+			t.Fatal("should redirect once from the cache", rr.Code, rr.Body.String())
+		}
+		check404("GET", "https://r.mrzm.io/cache/nothing", redirecter, t)
+		if recorder.hits.Load() != 2 {
+			t.Fatal("hits from the cache should be recorded", recorder.hits.Load())
+		}
+		if stats, ok := redirecter.CacheStats(); !ok || stats.Hits != 2 || stats.Misses != 2 {
+			t.Fatal("cache stats not match", stats)
+		}
+		redirecter.Invalidate(id)
+		check404("GET", "https://r.mrzm.io/cache/"+id.Base58(), redirecter, t)
+	}
+}
@@ -1,53 +1,793 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"github.com/bwmarrin/snowflake"
 	"github.com/jessevdk/go-flags"
+	"io"
 	"log"
+	"net/url"
+	"os"
+	"path/filepath"
 	"shorturl"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var opts struct {
-	Filename string `short:"f" long:"file" description:"path to sqlite3 db" required:"true"`
+	Filename string `short:"f" long:"file" description:"path to sqlite3 db"`
+	Dsn      string `long:"dsn" description:"postgres DSN (postgres://...), used instead of --file"`
 	NodeId   int64  `short:"n" long:"node" description:"node id for snowflake" default:"1"`
-	ExpireIn int64  `short:"e" long:"expire" description:"expire in (seconds)" default:"-1"`
+	TimeZone string `long:"tz" description:"time zone of the times without one, e.g. Asia/Tokyo" default:"Local"`
+	Format   string `long:"format" description:"format of import/export, csv or jsonl, guessed by the file extension if empty"`
+	Batch    int    `long:"batch" description:"links inserted per transaction when importing" default:"1000"`
+	BaseUrl  string `short:"b" long:"base" description:"base url of the short links, required by qr"`
+	QrSize   int    `long:"qr-size" description:"qr code size in pixels" default:"256"`
+	QrLevel  string `long:"qr-level" description:"qr code error correction level, L, M, Q or H" default:"M"`
+	Json     bool   `long:"json" description:"print the links in JSON, one object per line"`
+
+	Add     addCommand     `command:"add" description:"shorten a url, reusing the existing link if any"`
+	Alias   aliasCommand   `command:"alias" description:"shorten a url and reserve a vanity alias for it"`
+	Show    showCommand    `command:"show" description:"show the details of a link"`
+	List    listCommand    `command:"list" description:"list the links, newest first"`
+	Search  searchCommand  `command:"search" description:"list the links whose destination contains the substring"`
+	Stats   statsCommand   `command:"stats" description:"show the daily redirect counts of a link"`
+	Update  updateCommand  `command:"update" description:"change the destination, the expiry and/or the redirect code"`
+	History historyCommand `command:"history" description:"show the previous destinations of a link"`
+	Delete  deleteCommand  `command:"delete" description:"delete links with their aliases"`
+	Disable disableCommand `command:"disable" description:"disable links temporarily, so they respond 410 Gone"`
+	Enable  enableCommand  `command:"enable" description:"enable disabled links"`
+	Import  importCommand  `command:"import" description:"bulk load links from CSV / JSON Lines"`
+	Export  exportCommand  `command:"export" description:"dump links as CSV / JSON Lines"`
+	Qr      qrCommand      `command:"qr" description:"write the QR code of a link"`
+	Info    infoCommand    `command:"info" description:"print the node id, row counts & schema version of the db"`
+	Clean   cleanCommand   `command:"clean" description:"remove the expired links"`
+	Migrate migrateCommand `command:"migrate" description:"upgrade the schema of an existing db"`
 }
 
+// bk is opened by openManager and closed once the command is done
+var bk shorturl.Backend
+
+// loc is the location of --tz, loaded before running the command
+var loc *time.Location
+
+// base is the parsed --base, nil if not set
+var base *url.URL
+
 func main() {
-	args, err := flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		var err error
+		if loc, err = time.LoadLocation(opts.TimeZone); err != nil {
+			return fmt.Errorf("invalid --tz: %v", err)
+		}
+		if opts.BaseUrl != "" {
+			if base, err = shorturl.ParseBaseUrl(opts.BaseUrl); err != nil {
+				return fmt.Errorf("invalid --base: %v", err)
+			}
+		}
+		return command.Execute(args)
+	}
+	_, err := parser.Parse()
+	if bk != nil {
+		_ = bk.Close()
+	}
 	if err != nil {
-		log.Fatalln(err)
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(1)
+	}
+}
+
+func source() (string, error) {
+	if opts.Dsn != "" {
+		return opts.Dsn, nil
 	}
-	bk, err := shorturl.SqliteOpen(opts.Filename, true, opts.NodeId)
+	if opts.Filename == "" {
+		return "", fmt.Errorf("either --file or --dsn is required")
+	}
+	return opts.Filename, nil
+}
+
+// openManager opens the backend read-only unless isWrite, so the commands
+// only reading neither create the db nor migrate the schema
+func openManager(isWrite bool) (*shorturl.Manager, error) {
+	source, err := source()
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	defer func(bk shorturl.Backend) {
-		_ = bk.Close()
-	}(bk)
-	mgr, err := shorturl.NewManager(bk)
+	opened, err := shorturl.OpenBackend(source, isWrite, opts.NodeId)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	expireAt := int64(-1)
-	if opts.ExpireIn > 0 {
-		expireAt = time.Now().Unix() + opts.ExpireIn
+	bk = opened
+	return shorturl.NewManager(bk)
+}
+
+// findLink returns the link in any state, unlike Manager.Query hiding the expired ones
+func findLink(mgr *shorturl.Manager, id snowflake.ID) (*shorturl.UrlEntry, error) {
+	entries, err := mgr.List(shorturl.LinkFilter{MinId: uint64(id), MaxId: uint64(id) + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("link not found: %s", id.Base58())
+	}
+	return &entries[0], nil
+}
+
+func parseCode(code string) (snowflake.ID, error) {
+	id, err := snowflake.ParseBase58([]byte(code))
+	if err != nil {
+		return 0, fmt.Errorf("invalid code %q: %v", code, err)
 	}
-	switch args[0] {
-	case "add":
-		insert(mgr, args[1], expireAt)
-	case "clean":
-		if err = mgr.Clean(); err != nil {
-			log.Fatalln("failed on cleaning:", err)
+	return id, nil
+}
+
+type expiryFlags struct {
+	ExpireIn duration `short:"e" long:"expire" description:"expire in, seconds or durations like 90m, 3d12h or 2w; never if <= 0"`
+	ExpireAt string   `long:"expire-at" description:"expire at, RFC3339, 2006-01-02[ 15:04[:05]] in --tz or unix seconds; a date only means the end of that day"`
+}
+
+func (f *expiryFlags) isSet() bool {
+	return f.ExpireIn != "" || f.ExpireAt != ""
+}
+
+func (f *expiryFlags) expireAt() (int64, error) {
+	return resolveTime("--expire-at", f.ExpireAt, "--expire", string(f.ExpireIn), shorturl.ParseHumanTime)
+}
+
+// linkFlags are the options of the links created by add & alias
+type linkFlags struct {
+	expiryFlags
+	ActAt    string   `long:"activate-at" description:"the link does not resolve before the time, in the formats of --expire-at; a date only means the start of that day"`
+	ActIn    duration `long:"activate-in" description:"the link does not resolve in the duration, in the formats of --expire"`
+	Code     int      `short:"c" long:"code" description:"redirect status code, 301, 302 (default), 307 or 308"`
+	Visits   int64    `long:"max-visits" description:"the link expires after the visits, unlimited if <= 0"`
+	Password string   `long:"password" description:"protect the link by a password, read from stdin if -"`
+}
+
+// options reads the password from stdin if --password is -
+func (f *linkFlags) options() (shorturl.LinkOptions, error) {
+	password := f.Password
+	if password == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return shorturl.LinkOptions{}, err
+		}
+		password = strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return shorturl.LinkOptions{}, fmt.Errorf("empty password")
+		}
+	}
+	expireAt, err := f.expireAt()
+	if err != nil {
+		return shorturl.LinkOptions{}, err
+	}
+	activateAt, err := resolveTime("--activate-at", f.ActAt, "--activate-in", string(f.ActIn), shorturl.ParseHumanStartTime)
+	if err != nil {
+		return shorturl.LinkOptions{}, err
+	}
+	return shorturl.LinkOptions{
+		ExpireAt:     expireAt,
+		ActivateAt:   activateAt,
+		RedirectCode: f.Code,
+		Password:     password,
+		MaxVisits:    f.Visits,
+	}, nil
+}
+
+// duration is in the formats of shorturl.ParseHumanDuration, go-flags would
+// refuse the negative seconds like `-e -1` as an option otherwise
+type duration string
+
+func (d duration) IsValidValue(value string) error {
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil && strings.HasPrefix(value, "-") {
+		return fmt.Errorf("expected a duration, but got option `%s'", value)
+	}
+	return nil
+}
+
+// resolveTime returns the unix time of the absolute flag parsed by parse or
+// the relative one, -1 if neither is set
+func resolveTime(atFlag string, at string, inFlag string, in string, parse func(string, *time.Location) (time.Time, error)) (int64, error) {
+	if at != "" && in != "" {
+		return 0, fmt.Errorf("%s conflicts with %s", atFlag, inFlag)
+	}
+	if at != "" {
+		t, err := parse(at, loc)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %v", atFlag, err)
 		}
+		return t.Unix(), nil
 	}
+	if in != "" {
+		d, err := shorturl.ParseHumanDuration(in)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %v", inFlag, err)
+		}
+		if d > 0 {
+			return time.Now().Add(d).Unix(), nil
+		}
+	}
+	return -1, nil
+}
+
+type codeArgs struct {
+	Args struct {
+		Code string `positional-arg-name:"code"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type codesArgs struct {
+	Args struct {
+		Codes []string `positional-arg-name:"code" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type pathArgs struct {
+	Args struct {
+		Path string `positional-arg-name:"file|-"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type addCommand struct {
+	linkFlags
+	Args struct {
+		Url string `positional-arg-name:"url"`
+	} `positional-args:"yes" required:"yes"`
 }
 
-func insert(mgr *shorturl.Manager, url string, expireAt int64) {
-	id, err := mgr.InsertOrReuse(url, expireAt)
+func (c *addCommand) Execute([]string) error {
+	options, err := c.options()
+	if err != nil {
+		return err
+	}
+	mgr, err := openManager(true)
+	if err != nil {
+		return err
+	}
+	id, err := mgr.InsertOrReuseWithOptions(c.Args.Url, options)
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	return printLink(mgr, id, "")
+}
+
+type aliasCommand struct {
+	linkFlags
+	Args struct {
+		Slug string `positional-arg-name:"slug"`
+		Url  string `positional-arg-name:"url"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *aliasCommand) Execute([]string) error {
+	options, err := c.options()
+	if err != nil {
+		return err
+	}
+	mgr, err := openManager(true)
+	if err != nil {
+		return err
+	}
+	id, err := mgr.InsertWithAlias(c.Args.Url, options, c.Args.Slug)
+	if err != nil {
+		return err
+	}
+	return printLink(mgr, id, c.Args.Slug)
+}
+
+type showCommand struct {
+	codeArgs
+}
+
+func (c *showCommand) Execute([]string) error {
+	id, err := parseCode(c.Args.Code)
+	if err != nil {
+		return err
+	}
+	mgr, err := openManager(false)
+	if err != nil {
+		return err
+	}
+	entry, err := findLink(mgr, id)
+	if err != nil {
+		return err
+	}
+	counts, err := mgr.Stats(id)
+	if err != nil {
+		return err
+	}
+	link := toLink(entry, time.Now().Unix())
+	clicks := int64(0)
+	for _, count := range counts {
+		clicks += count.Count
+	}
+	link.Clicks = &clicks
+	if opts.Json {
+		return printJson(link)
+	}
+	fmt.Println("code:", link.Code)
+	if link.ShortUrl != "" {
+		fmt.Println("short url:", link.ShortUrl)
+	}
+	fmt.Println("url:", link.Url)
+	fmt.Println("state:", link.State)
+	fmt.Println("created at:", formatTime(&link.CreatedAt))
+	fmt.Println("activate at:", formatTime(link.ActivateAt))
+	fmt.Println("expire at:", formatTime(link.ExpireAt))
+	fmt.Println("redirect code:", link.RedirectCode)
+	fmt.Println("protected:", link.Protected)
+	if link.VisitsLeft != nil {
+		fmt.Println("visits left:", *link.VisitsLeft)
+	}
+	fmt.Println("clicks:", clicks)
+	return nil
+}
+
+type listCommand struct {
+	State  string `long:"state" description:"filter by the state" choice:"all" choice:"active" choice:"expired" choice:"disabled" choice:"pending" default:"all"`
+	Since  string `long:"since" description:"created at or after, in the formats of --expire-at; a date only means the start of that day"`
+	Until  string `long:"until" description:"created before, in the formats of --expire-at"`
+	Limit  int    `long:"limit" description:"links per page, unlimited if <= 0" default:"50"`
+	Before string `long:"before" description:"code of the last link of the previous page, to fetch the next one"`
+}
+
+func (c *listCommand) Execute([]string) error {
+	return c.list("")
+}
+
+func (c *listCommand) list(contains string) error {
+	state, err := shorturl.ParseLinkState(c.State)
+	if err != nil {
+		return err
+	}
+	filter := shorturl.LinkFilter{State: state, Contains: contains, Limit: c.Limit}
+	if c.Since != "" {
+		since, err := shorturl.ParseHumanStartTime(c.Since, loc)
+		if err != nil {
+			return fmt.Errorf("invalid --since: %v", err)
+		}
+		filter.MinId = shorturl.IdAt(since)
+	}
+	if c.Until != "" {
+		until, err := shorturl.ParseHumanTime(c.Until, loc)
+		if err != nil {
+			return fmt.Errorf("invalid --until: %v", err)
+		}
+		filter.MaxId = max(shorturl.IdAt(until), 1)
+	}
+	if c.Before != "" {
+		before, err := parseCode(c.Before)
+		if err != nil {
+			return err
+		}
+		if filter.MaxId == 0 || uint64(before) < filter.MaxId {
+			filter.MaxId = uint64(before)
+		}
+	}
+	mgr, err := openManager(false)
+	if err != nil {
+		return err
+	}
+	entries, err := mgr.List(filter)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for i := range entries {
+		link := toLink(&entries[i], now)
+		if opts.Json {
+			if err = printJson(link); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println(link.Code, link.State, formatTime(&link.CreatedAt), formatTime(link.ExpireAt), link.Url)
+		}
+	}
+	if c.Limit > 0 && len(entries) == c.Limit && !opts.Json {
+		_, _ = fmt.Fprintln(os.Stderr, "more links may follow, see the next page by --before", snowflake.ID(entries[len(entries)-1].Id).Base58())
+	}
+	return nil
+}
+
+type searchCommand struct {
+	listCommand
+	Args struct {
+		Substring string `positional-arg-name:"substring"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *searchCommand) Execute([]string) error {
+	return c.list(c.Args.Substring)
+}
+
+type statsCommand struct {
+	codeArgs
+}
+
+func (c *statsCommand) Execute([]string) error {
+	id, err := parseCode(c.Args.Code)
+	if err != nil {
+		return err
+	}
+	mgr, err := openManager(false)
+	if err != nil {
+		return err
+	}
+	counts, err := mgr.Stats(id)
+	if err != nil {
+		return err
+	}
+	total := int64(0)
+	for _, c := range counts {
+		fmt.Println(c.Day, c.Count)
+		total += c.Count
+	}
+	fmt.Println("total", total)
+	return nil
+}
+
+type updateCommand struct {
+	expiryFlags
+	Code int `short:"c" long:"code" description:"the new redirect status code, 301, 302, 307 or 308"`
+	Args struct {
+		Code string `positional-arg-name:"code" required:"yes"`
+		Url  string `positional-arg-name:"url"`
+	} `positional-args:"yes"`
+}
+
+// Execute changes nothing unless all the changes are valid, the url is
+// optional if only the expiry or the redirect code changes
+func (c *updateCommand) Execute([]string) error {
+	id, err := parseCode(c.Args.Code)
+	if err != nil {
+		return err
+	}
+	var update shorturl.LinkUpdate
+	if c.Args.Url != "" {
+		update.Url = &c.Args.Url
+	}
+	if c.isSet() {
+		expireAt, err := c.expireAt()
+		if err != nil {
+			return err
+		}
+		update.ExpireAt = &expireAt
+	}
+	if c.Code != 0 {
+		update.RedirectCode = &c.Code
+	}
+	if update == (shorturl.LinkUpdate{}) {
+		return fmt.Errorf("nothing to update, a url, --expire, --expire-at or --code is required")
+	}
+	mgr, err := openManager(true)
+	if err != nil {
+		return err
+	}
+	if err = mgr.Update(id, update); err != nil {
+		return err
+	}
+	return printLink(mgr, id, "")
+}
+
+type historyCommand struct {
+	codeArgs
+}
+
+func (c *historyCommand) Execute([]string) error {
+	id, err := parseCode(c.Args.Code)
+	if err != nil {
+		return err
+	}
+	mgr, err := openManager(false)
+	if err != nil {
+		return err
+	}
+	entries, err := mgr.History(id)
+	if err != nil {
+		return err
+	}
+	for _, h := range entries {
+		expire := "never"
+		if h.ExpireAt.Valid {
+			expire = time.Unix(h.ExpireAt.Int64, 0).Format(time.RFC3339)
+		}
+		fmt.Println(time.Unix(h.ChangedAt, 0).Format(time.RFC3339), h.Url, expire)
+	}
+	return nil
+}
+
+type deleteCommand struct {
+	codesArgs
+}
+
+// existingIds opens the manager for writing and parses the codes, failing if
+// any of them is invalid or not found
+func existingIds(codes []string) (*shorturl.Manager, []snowflake.ID, error) {
+	ids := make([]snowflake.ID, len(codes))
+	for i, code := range codes {
+		id, err := parseCode(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids[i] = id
+	}
+	mgr, err := openManager(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range ids {
+		if _, err = findLink(mgr, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	return mgr, ids, nil
+}
+
+// Execute deletes nothing if any of the codes is not found
+func (c *deleteCommand) Execute([]string) error {
+	mgr, ids, err := existingIds(c.Args.Codes)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err = mgr.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type disableCommand struct {
+	codesArgs
+}
+
+func (c *disableCommand) Execute([]string) error {
+	mgr, ids, err := existingIds(c.Args.Codes)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err = mgr.Disable(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type enableCommand struct {
+	codesArgs
+}
+
+func (c *enableCommand) Execute([]string) error {
+	mgr, ids, err := existingIds(c.Args.Codes)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err = mgr.Enable(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cleanCommand struct{}
+
+func (c *cleanCommand) Execute([]string) error {
+	mgr, err := openManager(true)
+	if err != nil {
+		return err
+	}
+	deleted, err := mgr.Sweep()
+	if err != nil {
+		return fmt.Errorf("failed on cleaning: %v", err)
+	}
+	fmt.Println("deleted", deleted, "expired links")
+	return nil
+}
+
+type migrateCommand struct{}
+
+func (c *migrateCommand) Execute([]string) error {
+	source, err := source()
+	if err != nil {
+		return err
+	}
+	if shorturl.IsMemorySource(source) {
+		return fmt.Errorf("nothing to migrate in memory")
+	}
+	migrate := shorturl.SqliteMigrate
+	if shorturl.IsPostgresDsn(source) {
+		migrate = shorturl.PostgresMigrate
+	}
+	from, to, err := migrate(source)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		fmt.Println("already up to date, schema version", to)
+	} else {
+		fmt.Printf("migrated schema version %d -> %d\n", from, to)
+	}
+	return nil
+}
+
+type infoCommand struct{}
+
+func (c *infoCommand) Execute([]string) error {
+	mgr, err := openManager(false)
+	if err != nil {
+		return err
+	}
+	i, err := mgr.Info()
+	if err != nil {
+		return err
+	}
+	fmt.Println("backend:", i.Kind)
+	fmt.Println("node id:", i.NodeId)
+	fmt.Printf("schema version: %d (latest %d)\n", i.SchemaVersion, i.LatestSchemaVersion)
+	fmt.Println("urls:", i.Urls)
+	fmt.Println("  expired:", i.Expired)
+	fmt.Println("  disabled:", i.Disabled)
+	fmt.Println("aliases:", i.Aliases)
+	return nil
+}
+
+type qrCommand struct {
+	Args struct {
+		Code string `positional-arg-name:"code"`
+		Path string `positional-arg-name:"file.png|file.svg|-"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute writes the qr code of the short link as png or svg by the extension, or svg to stdout if path is "-"
+func (c *qrCommand) Execute([]string) error {
+	if base == nil {
+		return fmt.Errorf("--base is required by qr")
+	}
+	level, err := shorturl.ParseQrLevel(opts.QrLevel)
+	if err != nil {
+		return err
+	}
+	id, err := parseCode(c.Args.Code)
+	if err != nil {
+		return err
+	}
+	path := c.Args.Path
+	if _, err = openManager(false); err != nil {
+		return err
+	}
+	entry, err := bk.QueryById(uint64(id))
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("link not found: %s", c.Args.Code)
+	}
+	q, err := shorturl.EncodeQr([]byte(shorturl.ShortUrl(base, id.Base58())), level)
+	if err != nil {
+		return err
+	}
+	write := q.WriteSvg
+	if path != "-" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".png":
+			write = q.WritePng
+		case ".svg":
+		default:
+			return fmt.Errorf("unknown qr code format of %s, .png or .svg expected", path)
+		}
+	}
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return write(w, opts.QrSize)
+}
+
+type importCommand struct {
+	pathArgs
+}
+
+// Execute reads from stdin if path is "-"
+func (c *importCommand) Execute([]string) error {
+	path := c.Args.Path
+	format, err := shorturl.BulkFormat(opts.Format, path)
+	if err != nil {
+		return err
+	}
+	mgr, err := openManager(true)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	imported, failed := 0, 0
+	onError := func(line int, err error) {
+		failed++
+		log.Printf("line %d: %v", line, err)
+	}
+	var batch []*shorturl.BulkRecord
+	flush := func() error {
+		results, err := mgr.ImportBatch(batch)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			if result.Err != nil {
+				onError(batch[i].Line, result.Err)
+				continue
+			}
+			imported++
+			if result.Alias != "" {
+				fmt.Println(result.Alias, "->", result.Id.Base58())
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err = shorturl.ReadBulk(r, format, func(rec *shorturl.BulkRecord) error {
+		batch = append(batch, rec)
+		if len(batch) >= opts.Batch {
+			return flush()
+		}
+		return nil
+	}, onError)
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	fmt.Printf("imported %d, failed %d\n", imported, failed)
+	return err
+}
+
+type exportCommand struct {
+	pathArgs
+}
+
+// Execute writes to stdout if path is "-"
+func (c *exportCommand) Execute([]string) error {
+	path := c.Args.Path
+	format, err := shorturl.BulkFormat(opts.Format, path)
+	if err != nil {
+		return err
+	}
+	mgr, err := openManager(false)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw, err := shorturl.NewBulkWriter(w, format)
+	if err != nil {
+		return err
+	}
+	if err = mgr.Export(bw.Write); err != nil {
+		return err
 	}
-	fmt.Println(mgr.GetUrl(id))
+	return bw.Flush()
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/snowflake"
+	"os"
+	"shorturl"
+	"time"
+)
+
+// link is a link printed by the commands, in JSON with --json
+type link struct {
+	Code         string `json:"code"`
+	Alias        string `json:"alias,omitempty"`
+	ShortUrl     string `json:"short_url,omitempty"` // with --base only
+	Url          string `json:"url"`
+	State        string `json:"state"`
+	CreatedAt    int64  `json:"created_at"`
+	ActivateAt   *int64 `json:"activate_at"`
+	ExpireAt     *int64 `json:"expire_at"`
+	RedirectCode int    `json:"redirect_code"`
+	Protected    bool   `json:"protected"`
+	VisitsLeft   *int64 `json:"visits_left"`
+	Clicks       *int64 `json:"clicks,omitempty"` // by show only
+}
+
+func nullable(v int64, valid bool) *int64 {
+	if !valid {
+		return nil
+	}
+	return &v
+}
+
+func toLink(entry *shorturl.UrlEntry, now int64) *link {
+	id := snowflake.ID(entry.Id)
+	l := &link{
+		Code:         id.Base58(),
+		Url:          entry.Url,
+		State:        shorturl.StateOf(entry, now).String(),
+		CreatedAt:    id.Time() / 1000,
+		ActivateAt:   nullable(entry.ActivateAt.Int64, entry.ActivateAt.Valid),
+		ExpireAt:     nullable(entry.ExpireAt.Int64, entry.ExpireAt.Valid),
+		RedirectCode: entry.RedirectCode,
+		Protected:    entry.PasswordHash != "",
+		VisitsLeft:   nullable(entry.VisitsLeft.Int64, entry.VisitsLeft.Valid),
+	}
+	if l.RedirectCode == 0 {
+		l.RedirectCode = 302
+	}
+	if base != nil {
+		l.ShortUrl = shorturl.ShortUrl(base, l.Code)
+	}
+	return l
+}
+
+// formatTime formats the unix time in --tz, "never" if nil
+func formatTime(t *int64) string {
+	if t == nil {
+		return "never"
+	}
+	return time.Unix(*t, 0).In(loc).Format(time.RFC3339)
+}
+
+func printJson(v any) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// printLink prints the code, after the alias if any, with the resolved
+// absolute expiry & activation time
+func printLink(mgr *shorturl.Manager, id snowflake.ID, alias string) error {
+	entry, err := mgr.Query(id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("link not found: %s", id.Base58())
+	}
+	l := toLink(entry, time.Now().Unix())
+	l.Alias = alias
+	if opts.Json {
+		return printJson(l)
+	}
+	var line []any
+	if alias != "" {
+		line = append(line, alias)
+	}
+	line = append(line, mgr.GetUrl(id))
+	if l.ActivateAt != nil {
+		line = append(line, "activates", formatTime(l.ActivateAt))
+	}
+	if l.ExpireAt != nil {
+		line = append(line, "expires", formatTime(l.ExpireAt))
+	}
+	fmt.Println(line...)
+	return nil
+}
@@ -1,19 +1,57 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"github.com/jessevdk/go-flags"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"shorturl"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var opts struct {
-	Filenames   []string `short:"f" long:"file" description:"path to sqlite3 db" required:"true"`
-	BaseUrl     string   `short:"b" long:"base" description:"base url" required:"true"`
-	Port        uint16   `short:"p" long:"port" description:"listen port" default:"8080"`
-	Strict      bool     `long:"strict" description:"strict mode, checking host"`
-	EnableCache bool     `long:"cache" description:"enable cache" default:"true"`
+	Filenames        []string `short:"f" long:"file" description:"path to sqlite3 db"`
+	Dsns             []string `long:"dsn" description:"postgres DSN (postgres://...)"`
+	Dir              string   `long:"dir" description:"directory of sqlite3 dbs attached & detached at runtime as they are added & removed, rescanned on SIGHUP"`
+	DirPattern       string   `long:"dir-pattern" description:"file name pattern of the dbs in --dir" default:"*.db"`
+	BaseUrl          string   `short:"b" long:"base" description:"base url" required:"true"`
+	Bind             string   `long:"bind" description:"listen address of the redirection & admin ports, all interfaces if empty"`
+	Port             uint16   `short:"p" long:"port" description:"listen port" default:"8080"`
+	ReadTimeout      int64    `long:"read-timeout" description:"time limit of reading a request incl. the body (seconds)" default:"10"`
+	WriteTimeout     int64    `long:"write-timeout" description:"time limit of writing a response (seconds)" default:"30"`
+	IdleTimeout      int64    `long:"idle-timeout" description:"time a keep-alive connection is kept idle (seconds)" default:"120"`
+	MaxHeaderBytes   int      `long:"max-header-bytes" description:"size limit of the request headers" default:"65536"`
+	ShutdownTimeout  int64    `long:"shutdown-timeout" description:"time waited for the requests in flight on SIGINT/SIGTERM (seconds)" default:"30"`
+	Strict           bool     `long:"strict" description:"strict mode, checking host"`
+	NoCache          bool     `long:"no-cache" description:"disable cache"`
+	Cache            bool     `long:"cache" description:"deprecated, the cache is enabled unless --no-cache" hidden:"yes"`
+	CacheSize        int      `long:"cache-size" description:"links cached at most, evicting the least recently used ones; unbounded if 0"`
+	CacheTtl         int64    `long:"cache-ttl" description:"the most a link is cached (seconds)" default:"300"`
+	NegativeTtl      int64    `long:"cache-negative-ttl" description:"the most a code not found is cached (seconds)" default:"300"`
+	ApiFile          string   `long:"api-file" description:"path to sqlite3 db, postgres DSN or memory: written by the management api, api disabled if empty"`
+	ApiNodeId        int64    `long:"api-node" description:"node id for snowflake used by the management api" default:"1"`
+	ApiPort          uint16   `long:"api-port" description:"listen port of the management api" default:"8081"`
+	ApiBind          string   `long:"api-bind" description:"listen address of the management api, all interfaces if empty" default:"127.0.0.1"`
+	ApiToken         string   `long:"api-token" env:"SURL_API_TOKEN" description:"bearer token required by the management api"`
+	AdminPort        uint16   `long:"admin-port" description:"listen port of /metrics in the Prometheus text format, disabled if 0"`
+	Stats            bool     `long:"stats" description:"record per-link per-day redirect counts"`
+	StatsFlush       int64    `long:"stats-flush" description:"interval of persisting redirect counts (seconds)" default:"60"`
+	Sweep            int64    `long:"sweep" description:"interval of deleting the expired links from the DBs (seconds), disabled if 0"`
+	SweepBatch       int      `long:"sweep-batch" description:"expired links deleted per transaction when sweeping" default:"500"`
+	AccessLog        string   `long:"access-log" description:"path of the access log, - for stdout, disabled if empty"`
+	AccessLogFormat  string   `long:"access-log-format" description:"format of the access log" choice:"json" choice:"clf" default:"json"`
+	AccessLogMaxSize int64    `long:"access-log-max-size" description:"size of the access log file rotated at (MB)" default:"100"`
+	AccessLogBackups int      `long:"access-log-backups" description:"rotated access log files kept" default:"5"`
+	AccessLogSample  float64  `long:"access-log-sample" description:"fraction of the requests logged, the failed ones (5xx) are always logged" default:"1"`
+	Secret           string   `long:"cookie-secret" description:"secret signing the cookies of password-protected links & keying the hashes of the visitor ips, random if empty; share it among the instances behind a load balancer"`
 }
 
 func main() {
@@ -21,9 +59,148 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	redirecter, err := shorturl.NewRedirecter(opts.Filenames, opts.BaseUrl, opts.Strict, opts.EnableCache)
+	sources := append(opts.Filenames, opts.Dsns...)
+	var mgr *shorturl.Manager
+	var apiBk shorturl.Backend
+	if opts.ApiFile != "" {
+		if opts.ApiToken == "" {
+			log.Fatalln("--api-token or SURL_API_TOKEN is required by --api-file")
+		}
+		// opened before the others, so the db is created if not existed
+		apiBk, err = shorturl.OpenBackend(opts.ApiFile, true, opts.ApiNodeId)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mgr, err = shorturl.NewManager(apiBk)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(sources) == 0 && apiBk == nil && opts.Dir == "" {
+		log.Fatalln("at least one --file, --dsn or --dir is required")
+	}
+	var bks []shorturl.Backend
+	if apiBk != nil {
+		bks = append(bks, apiBk)
+	}
+	for _, source := range sources {
+		if source == opts.ApiFile {
+			continue
+		}
+		bk, err := shorturl.OpenBackend(source, false, 0)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		bks = append(bks, bk)
+	}
+	redirecter, err := shorturl.NewRedirecterWithBackends(bks, opts.BaseUrl, opts.Strict, !opts.NoCache)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%v", opts.Port), redirecter))
+	if !opts.NoCache {
+		var linkCache shorturl.LinkCache
+		if opts.CacheSize > 0 {
+			linkCache = shorturl.NewLruCache(opts.CacheSize)
+		} else {
+			linkCache = shorturl.NewGoCache(10 * time.Minute)
+		}
+		redirecter.SetCache(linkCache, time.Duration(opts.CacheTtl)*time.Second, time.Duration(opts.NegativeTtl)*time.Second)
+	}
+	if apiBk != nil && !slices.Contains(sources, opts.ApiFile) {
+		sources = append(sources, opts.ApiFile)
+	}
+	redirecter.WatchFiles(sources)
+	var watcher *shorturl.DirWatcher
+	if opts.Dir != "" {
+		watcher, err = redirecter.WatchDir(opts.Dir, opts.DirPattern)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Println("SIGHUP received, rescanning", opts.Dir)
+				watcher.Reload()
+			}
+		}()
+	}
+	if opts.Secret != "" {
+		redirecter.SetCookieSecret([]byte(opts.Secret))
+	}
+	if opts.Stats {
+		redirecter.EnableStats(time.Duration(opts.StatsFlush) * time.Second)
+	}
+	if opts.AccessLog != "" {
+		format, err := shorturl.ParseAccessLogFormat(opts.AccessLogFormat)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		var w io.Writer = os.Stdout
+		if opts.AccessLog != "-" {
+			w, err = shorturl.OpenRotatingFile(opts.AccessLog, opts.AccessLogMaxSize<<20, opts.AccessLogBackups)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+		redirecter.SetAccessLog(shorturl.NewAccessLog(w, format, opts.AccessLogSample, 4096))
+	}
+	var sweeper *shorturl.Sweeper
+	if opts.Sweep > 0 {
+		sweeper = redirecter.EnableSweeper(time.Duration(opts.Sweep)*time.Second, opts.SweepBatch)
+	}
+	servers := []*http.Server{newServer(opts.Bind, opts.Port, redirecter)}
+	if opts.AdminPort != 0 {
+		admin := http.NewServeMux()
+		admin.Handle("GET /metrics", redirecter.Metrics())
+		servers = append(servers, newServer(opts.Bind, opts.AdminPort, admin))
+	}
+	if mgr != nil {
+		api := shorturl.NewApi(mgr, redirecter, opts.ApiToken)
+		servers = append(servers, newServer(opts.ApiBind, opts.ApiPort, api.Handler()))
+	}
+	for _, srv := range servers {
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("%v received, shutting down", <-stop)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.ShutdownTimeout)*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("failed on shutting down %s gracefully: %v", srv.Addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if watcher != nil {
+		_ = watcher.Close()
+	}
+	if sweeper != nil {
+		_ = sweeper.Close()
+	}
+	if err = redirecter.Close(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func newServer(bind string, port uint16, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           net.JoinHostPort(bind, strconv.Itoa(int(port))),
+		Handler:        handler,
+		ReadTimeout:    time.Duration(opts.ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(opts.WriteTimeout) * time.Second,
+		IdleTimeout:    time.Duration(opts.IdleTimeout) * time.Second,
+		MaxHeaderBytes: opts.MaxHeaderBytes,
+	}
 }
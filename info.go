@@ -0,0 +1,170 @@
+package shorturl
+
+import (
+	"fmt"
+	"github.com/bwmarrin/snowflake"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type linkInfo struct {
+	Id         string `json:"id"`
+	ShortUrl   string `json:"short_url"`
+	Url        string `json:"url,omitempty"` // hidden if protected by a password, or limited
+	Protected  bool   `json:"protected"`
+	CreatedAt  int64  `json:"created_at"`
+	ExpireAt   *int64 `json:"expire_at"`
+	VisitsLeft *int64 `json:"visits_left"`
+	Clicks     int64  `json:"clicks"`
+}
+
+var infoTemplate = template.Must(template.New("info").Funcs(template.FuncMap{
+	"time": func(unix int64) string {
+		return time.Unix(unix, 0).UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+	"deref": func(v *int64) int64 { return *v },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.ShortUrl}}</title>
+</head>
+<body>
+<h1>{{.ShortUrl}}</h1>
+<dl>
+<dt>Destination</dt><dd>{{if .Url}}<a href="{{.Url}}" rel="nofollow noreferrer">{{.Url}}</a>{{else if .Protected}}protected by a password{{else}}hidden{{end}}</dd>
+<dt>Created</dt><dd>{{time .CreatedAt}}</dd>
+<dt>Expires</dt><dd>{{if .ExpireAt}}{{time (deref .ExpireAt)}}{{else}}never{{end}}</dd>
+{{if .VisitsLeft}}<dt>Visits left</dt><dd>{{deref .VisitsLeft}}</dd>
+{{end}}<dt>Clicks</dt><dd>{{.Clicks}}</dd>
+</dl>
+</body>
+</html>
+`))
+
+// lookupPage finds the link for the pages about it, returns nil once the error response is written
+func (r *Redirecter) lookupPage(w http.ResponseWriter, req *http.Request, code string) *UrlEntry {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(405)
+		_, _ = io.WriteString(w, "method not allowed")
+		return nil
+	}
+	entry, _, err := r.lookup(code)
+	if err != nil {
+		log.Printf("failed on querying %s: %v", code, err)
+		w.WriteHeader(500)
+		_, _ = io.WriteString(w, "temporarily error")
+		return nil
+	}
+	if entry == nil {
+		w.WriteHeader(404)
+		_, _ = io.WriteString(w, "not found")
+		return nil
+	}
+	if entry.Disabled {
+		w.WriteHeader(410)
+		_, _ = io.WriteString(w, "gone")
+		return nil
+	}
+	return entry
+}
+
+// serveInfo renders the preview page of code, as JSON if asked by the Accept header
+func (r *Redirecter) serveInfo(w http.ResponseWriter, req *http.Request, code string) {
+	entry := r.lookupPage(w, req, code)
+	if entry == nil {
+		return
+	}
+	id := snowflake.ID(entry.Id)
+	info := linkInfo{
+		Id:        id.Base58(),
+		ShortUrl:  r.ShortUrl(id),
+		Url:       entry.Url,
+		Protected: entry.PasswordHash != "",
+		CreatedAt: id.Time() / 1000,
+	}
+	if info.Protected {
+		w.Header().Set("Cache-Control", "private, no-store")
+		if !r.unlocked(req, entry) {
+			info.Url = ""
+		}
+	}
+	if entry.ExpireAt.Valid {
+		info.ExpireAt = &entry.ExpireAt.Int64
+	}
+	if entry.VisitsLeft.Valid {
+		// showing the destination would bypass the limit
+		info.VisitsLeft = &entry.VisitsLeft.Int64
+		info.Url = ""
+	}
+	if bk, ok := r.backend(id.Node()); ok {
+		counts, err := bk.QueryHitCounts(entry.Id)
+		if err != nil {
+			log.Printf("failed on querying hit counts of %s: %v", code, err)
+		}
+		for _, c := range counts {
+			info.Clicks += c.Count
+		}
+	}
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		writeJson(w, 200, info)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := infoTemplate.Execute(w, info); err != nil {
+		log.Printf("failed on rendering info of %s: %v", code, err)
+	}
+}
+
+const (
+	qrDefaultSize = 256
+	qrMaxSize     = 2048
+)
+
+// serveQr renders the QR code of the short link of code, as png or svg by the extension.
+// Optional query parameters: size in pixels & ec for the error correction level (L, M, Q or H).
+func (r *Redirecter) serveQr(w http.ResponseWriter, req *http.Request, code string, ext string) {
+	size := qrDefaultSize
+	if s := req.URL.Query().Get("size"); s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil || size <= 0 || size > qrMaxSize {
+			w.WriteHeader(400)
+			_, _ = fmt.Fprintf(w, "size should be 1 ~ %d", qrMaxSize)
+			return
+		}
+	}
+	level, err := ParseQrLevel(req.URL.Query().Get("ec"))
+	if err != nil {
+		w.WriteHeader(400)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+	if r.lookupPage(w, req, code) == nil {
+		return
+	}
+	// aliases are kept, for the shorter codes
+	qr, err := EncodeQr([]byte(ShortUrl(r.baseUrl, code)), level)
+	if err != nil {
+		log.Printf("failed on encoding qr code of %s: %v", code, err)
+		w.WriteHeader(500)
+		_, _ = io.WriteString(w, "temporarily error")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if ext == ".svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = qr.WriteSvg(w, size)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		err = qr.WritePng(w, size)
+	}
+	if err != nil {
+		log.Printf("failed on rendering qr code of %s: %v", code, err)
+	}
+}
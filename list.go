@@ -0,0 +1,107 @@
+package shorturl
+
+import (
+	"fmt"
+	"github.com/bwmarrin/snowflake"
+	"strings"
+	"time"
+)
+
+// LinkState is the state of a link at a time, a link in several states is in
+// the first one of expired, disabled, pending and active
+type LinkState int
+
+const (
+	AnyState LinkState = iota
+	ActiveState
+	ExpiredState // expired, or the visits used up
+	DisabledState
+	PendingState // not activated yet
+)
+
+var linkStateNames = []string{"all", "active", "expired", "disabled", "pending"}
+
+func (s LinkState) String() string {
+	if s < 0 || int(s) >= len(linkStateNames) {
+		return fmt.Sprintf("LinkState(%d)", int(s))
+	}
+	return linkStateNames[s]
+}
+
+func ParseLinkState(s string) (LinkState, error) {
+	for i, name := range linkStateNames {
+		if s == name {
+			return LinkState(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown link state %q, one of %s expected", s, strings.Join(linkStateNames, ", "))
+}
+
+func StateOf(entry *UrlEntry, now int64) LinkState {
+	switch {
+	case !isAlive(entry, now):
+		return ExpiredState
+	case entry.Disabled:
+		return DisabledState
+	case !isActive(entry, now):
+		return PendingState
+	}
+	return ActiveState
+}
+
+// LinkFilter selects the links listed by Backend.ListUrls, newest first
+type LinkFilter struct {
+	State    LinkState
+	MinId    uint64 // inclusive, see IdAt for filtering by the creation time
+	MaxId    uint64 // exclusive, unbounded if 0; the last id of a page starts the next one
+	Contains string // substring of the destination, case-sensitive
+	Limit    int    // unlimited if <= 0
+}
+
+// IdAt returns the smallest snowflake id generated at t or later
+func IdAt(t time.Time) uint64 {
+	ms := t.UnixMilli() - snowflake.Epoch
+	if ms < 0 {
+		return 0
+	}
+	return uint64(ms) << (snowflake.NodeBits + snowflake.StepBits)
+}
+
+func (f *LinkFilter) matches(entry *UrlEntry, now int64) bool {
+	return entry.Id >= f.MinId && (f.MaxId == 0 || entry.Id < f.MaxId) &&
+		strings.Contains(entry.Url, f.Contains) &&
+		(f.State == AnyState || StateOf(entry, now) == f.State)
+}
+
+// listUrlsQuery builds the query of ListUrls for the sql backends, param
+// formats the n-th placeholder, contains the substring condition of 2 operands
+func listUrlsQuery(f *LinkFilter, now int64, param func(n int) string, contains string) (string, []any) {
+	args := []any{now}
+	arg := func(v any) string {
+		args = append(args, v)
+		return param(len(args))
+	}
+	alive := `(expire_at IS NULL OR expire_at > ` + param(1) + `) AND (visits_left IS NULL OR visits_left > 0)`
+	conds := []string{`id >= ` + arg(int64(f.MinId))}
+	if f.MaxId != 0 {
+		conds = append(conds, `id < `+arg(int64(f.MaxId)))
+	}
+	if f.Contains != "" {
+		conds = append(conds, fmt.Sprintf(contains, `url`, arg(f.Contains)))
+	}
+	switch f.State {
+	case ActiveState:
+		conds = append(conds, alive, `NOT disabled`, `(activate_at IS NULL OR activate_at <= `+param(1)+`)`)
+	case ExpiredState:
+		conds = append(conds, `NOT (`+alive+`)`)
+	case DisabledState:
+		conds = append(conds, alive, `disabled`)
+	case PendingState:
+		conds = append(conds, alive, `NOT disabled`, `activate_at > `+param(1))
+	}
+	query := `SELECT ` + urlColumns + ` FROM url WHERE ` + strings.Join(conds, ` AND `) + ` ORDER BY id DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ` + arg(f.Limit)
+	}
+	return query, args
+}
@@ -5,11 +5,16 @@ import (
 	"fmt"
 	"github.com/bwmarrin/snowflake"
 	"net/url"
+	"regexp"
 	"time"
 )
 
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{2,63}$`)
+
+const snowflakeEpoch = 1657436936000 // 2022/7/10 7:8:56 UTC
+
 func NewManager(bk Backend) (*Manager, error) {
-	snowflake.Epoch = 1657436936000 // 2022/7/10 7:8:56 UTC
+	snowflake.Epoch = snowflakeEpoch
 	bkNodeId, err := bk.getNodeId()
 	if err != nil {
 		return nil, err
@@ -18,30 +23,98 @@ func NewManager(bk Backend) (*Manager, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Manager{node, bk}, nil
+	return &Manager{node, bkNodeId, bk}, nil
 }
 
 func (m *Manager) GetUrl(id snowflake.ID) string {
 	return id.Base58()
 }
 
-func (m *Manager) InsertOrReuse(dstUrl string, expireAt int64) (snowflake.ID, error) {
+// InvalidLinkError is the error of the invalid attributes of a link, unlike
+// the failures of the backend
+type InvalidLinkError struct {
+	Err error
+}
+
+func (e *InvalidLinkError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidLinkError) Unwrap() error {
+	return e.Err
+}
+
+func invalidLink(format string, a ...any) error {
+	return &InvalidLinkError{fmt.Errorf(format, a...)}
+}
+
+func validateDst(dstUrl string, expireAt int64) error {
 	parsedDst, err := url.ParseRequestURI(dstUrl)
 	if err != nil {
-		return 0, err
+		return &InvalidLinkError{err}
 	}
 	if parsedDst.Scheme == "" {
-		return 0, fmt.Errorf("not a valid dst url")
+		return invalidLink("not a valid dst url")
 	}
 	if expireAt > 0 && time.Now().Unix() > expireAt {
-		return 0, fmt.Errorf("already expired")
+		return invalidLink("already expired")
+	}
+	return nil
+}
+
+func validateActivation(activateAt int64, expireAt int64) error {
+	if activateAt > 0 && expireAt > 0 && activateAt >= expireAt {
+		return invalidLink("activated after expiry")
+	}
+	return nil
+}
+
+func normalizeRedirectCode(code int) (int, error) {
+	switch code {
+	case 0:
+		return 302, nil
+	case 301, 302, 307, 308:
+		return code, nil
+	}
+	return 0, invalidLink("%d is not a supported redirect code, 301, 302, 307 or 308 expected", code)
+}
+
+func (m *Manager) InsertOrReuse(dstUrl string, expireAt int64) (snowflake.ID, error) {
+	return m.InsertOrReuseWithOptions(dstUrl, LinkOptions{ExpireAt: expireAt})
+}
+
+func (m *Manager) InsertOrReuseWithOptions(dstUrl string, opts LinkOptions) (snowflake.ID, error) {
+	expireAt := opts.ExpireAt
+	if err := validateDst(dstUrl, expireAt); err != nil {
+		return 0, err
+	}
+	if err := validateActivation(opts.ActivateAt, expireAt); err != nil {
+		return 0, err
+	}
+	code, err := normalizeRedirectCode(opts.RedirectCode)
+	if err != nil {
+		return 0, err
+	}
+	passwordHash := ""
+	if opts.Password != "" {
+		if passwordHash, err = HashPassword(opts.Password); err != nil {
+			return 0, err
+		}
 	}
 	existing, err := m.bk.QueryByUrl(dstUrl)
 	if err != nil {
 		return 0, err
 	}
+	// existing ones are active already, a link activated in future is never reused
+	if opts.ActivateAt > time.Now().Unix() {
+		existing = nil
+	}
 	for _, entry := range existing {
-		if expireAt < 0 && !entry.ExpireAt.Valid {
+		// the salted hashes can not be compared, protected links are never reused, nor limited ones
+		if entryRedirectCode(&entry) != code || passwordHash != "" || entry.PasswordHash != "" || opts.MaxVisits > 0 || entry.VisitsLeft.Valid {
+			continue
+		}
+		if expireAt <= 0 && !entry.ExpireAt.Valid {
 			return snowflake.ID(entry.Id), nil
 		}
 		if expireAt > 0 && entry.ExpireAt.Valid && entry.ExpireAt.Int64 == expireAt {
@@ -50,13 +123,254 @@ func (m *Manager) InsertOrReuse(dstUrl string, expireAt int64) (snowflake.ID, er
 	}
 	id := m.snode.Generate()
 	realExpireAt := sql.NullInt64{Int64: expireAt, Valid: expireAt > 0}
-	err = m.bk.InsertUrl(&UrlEntry{Id: uint64(id), Url: dstUrl, ExpireAt: realExpireAt})
+	visitsLeft := sql.NullInt64{Int64: opts.MaxVisits, Valid: opts.MaxVisits > 0}
+	activateAt := sql.NullInt64{Int64: opts.ActivateAt, Valid: opts.ActivateAt > 0}
+	err = m.bk.InsertUrl(&UrlEntry{Id: uint64(id), Url: dstUrl, ExpireAt: realExpireAt, ActivateAt: activateAt, RedirectCode: code, PasswordHash: passwordHash, VisitsLeft: visitsLeft})
 	if err != nil {
 		return 0, err
 	}
 	return id, nil
 }
 
+// queryAlias validates the alias, returns the id of the link it's taken by, 0 if free
+func (m *Manager) queryAlias(alias string) (uint64, error) {
+	if !aliasPattern.MatchString(alias) {
+		return 0, fmt.Errorf("invalid alias %q, 3-64 chars of letters, digits, '-' or '_' expected", alias)
+	}
+	return m.bk.QueryAlias(alias)
+}
+
+func (m *Manager) ReserveAlias(alias string, id snowflake.ID) error {
+	existing, err := m.queryAlias(alias)
+	if err != nil {
+		return err
+	}
+	if existing == uint64(id) {
+		return nil
+	}
+	if existing != 0 {
+		return fmt.Errorf("alias %q already taken by %s", alias, snowflake.ID(existing).Base58())
+	}
+	if err = m.checkExists(id); err != nil {
+		return err
+	}
+	return m.bk.InsertAlias(alias, uint64(id))
+}
+
+// InsertWithAlias shortens the url like InsertOrReuseWithOptions and reserves
+// the alias for it, nothing is inserted if the alias is invalid or taken
+func (m *Manager) InsertWithAlias(dstUrl string, opts LinkOptions, alias string) (snowflake.ID, error) {
+	existing, err := m.queryAlias(alias)
+	if err != nil {
+		return 0, err
+	}
+	if existing != 0 {
+		return 0, fmt.Errorf("alias %q already taken by %s", alias, snowflake.ID(existing).Base58())
+	}
+	id, err := m.InsertOrReuseWithOptions(dstUrl, opts)
+	if err != nil {
+		return 0, err
+	}
+	return id, m.bk.InsertAlias(alias, uint64(id))
+}
+
+// ImportResult is the outcome of importing a BulkRecord. The codes other than
+// the snowflake ids of this node, e.g. the ones of another shortener, are kept
+// as the Alias of a new Id.
+type ImportResult struct {
+	Id    snowflake.ID
+	Alias string
+	Err   error
+}
+
+// ImportBatch inserts the records without reusing existing links, records
+// without an id get a new one. Returns the result of each record in order.
+func (m *Manager) ImportBatch(records []*BulkRecord) ([]ImportResult, error) {
+	results := make([]ImportResult, len(records))
+	entries := make([]UrlEntry, 0, len(records))
+	indexes := make([]int, 0, len(records))
+	aliases := make(map[string]bool)
+	for i, rec := range records {
+		if err := validateDst(rec.Url, rec.ExpireAt); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := validateActivation(rec.ActivateAt, rec.ExpireAt); err != nil {
+			results[i].Err = err
+			continue
+		}
+		code, err := normalizeRedirectCode(rec.RedirectCode)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if rec.PasswordHash != "" {
+			if err = ValidatePasswordHash(rec.PasswordHash); err != nil {
+				results[i].Err = err
+				continue
+			}
+		}
+		id := m.snode.Generate()
+		if rec.Id != "" {
+			if parsed, err := snowflake.ParseBase58([]byte(rec.Id)); err == nil && parsed >= 1<<22 && parsed.Node() == m.nodeId {
+				id = parsed
+			} else if existing, err := m.queryAlias(rec.Id); err != nil {
+				results[i].Err = err
+				continue
+			} else if existing != 0 || aliases[rec.Id] {
+				results[i].Err = fmt.Errorf("alias %q already taken", rec.Id)
+				continue
+			} else {
+				aliases[rec.Id] = true
+				results[i].Alias = rec.Id
+			}
+		}
+		results[i].Id = id
+		entries = append(entries, UrlEntry{Id: uint64(id), Url: rec.Url, ExpireAt: sql.NullInt64{Int64: rec.ExpireAt, Valid: rec.ExpireAt > 0}, RedirectCode: code, Disabled: rec.Disabled, PasswordHash: rec.PasswordHash, VisitsLeft: sql.NullInt64{Int64: rec.VisitsLeft, Valid: rec.VisitsLeft > 0}, ActivateAt: sql.NullInt64{Int64: rec.ActivateAt, Valid: rec.ActivateAt > 0}})
+		indexes = append(indexes, i)
+	}
+	if len(entries) == 0 {
+		return results, nil
+	}
+	insertErrs, err := m.bk.InsertUrls(entries)
+	if err != nil {
+		return nil, err
+	}
+	for j, insertErr := range insertErrs {
+		result := &results[indexes[j]]
+		if insertErr == nil && result.Alias != "" {
+			// the link is not left behind without its code
+			if insertErr = m.bk.InsertAlias(result.Alias, uint64(result.Id)); insertErr != nil {
+				_ = m.bk.Delete(uint64(result.Id))
+			}
+		}
+		result.Err = insertErr
+	}
+	return results, nil
+}
+
+// Export skips the expired & used up links, which could not be imported
+func (m *Manager) Export(fn func(entry *UrlEntry) error) error {
+	now := time.Now().Unix()
+	return m.bk.Walk(func(entry *UrlEntry) error {
+		if !isAlive(entry, now) {
+			return nil
+		}
+		return fn(entry)
+	})
+}
+
+// Update validates all the fields set before changing any of them, then
+// changes them at once; the previous destination is kept in the history
+func (m *Manager) Update(id snowflake.ID, update LinkUpdate) error {
+	if update.Url != nil {
+		if err := validateDst(*update.Url, -1); err != nil {
+			return err
+		}
+	}
+	if update.RedirectCode != nil {
+		code, err := normalizeRedirectCode(*update.RedirectCode)
+		if err != nil {
+			return err
+		}
+		update.RedirectCode = &code
+	}
+	entry, err := m.Query(id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("%s not found", id.Base58())
+	}
+	if update.ExpireAt != nil {
+		expireAt := *update.ExpireAt
+		if expireAt > 0 && time.Now().Unix() > expireAt {
+			return invalidLink("already expired")
+		}
+		if err = validateActivation(entry.ActivateAt.Int64, expireAt); err != nil {
+			return err
+		}
+	}
+	return m.bk.UpdateLink(uint64(id), &update)
+}
+
+func (m *Manager) Retarget(id snowflake.ID, dstUrl string) error {
+	return m.Update(id, LinkUpdate{Url: &dstUrl})
+}
+
+// SetExpiry updates the expiration of the link, never expires if expireAt <= 0
+func (m *Manager) SetExpiry(id snowflake.ID, expireAt int64) error {
+	return m.Update(id, LinkUpdate{ExpireAt: &expireAt})
+}
+
+func (m *Manager) History(id snowflake.ID) ([]HistoryEntry, error) {
+	return m.bk.QueryHistory(uint64(id))
+}
+
+func (m *Manager) checkExists(id snowflake.ID) error {
+	entry, err := m.Query(id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("%s not found", id.Base58())
+	}
+	return nil
+}
+
+// Query returns the link including the one not active yet
+func (m *Manager) Query(id snowflake.ID) (*UrlEntry, error) {
+	entry, err := m.bk.QueryById(uint64(id))
+	if err != nil || entry != nil {
+		return entry, err
+	}
+	return m.bk.QueryPending(uint64(id))
+}
+
+// List returns the links matching the filter, newest first
+func (m *Manager) List(filter LinkFilter) ([]UrlEntry, error) {
+	return m.bk.ListUrls(filter)
+}
+
+func (m *Manager) Delete(id snowflake.ID) error {
+	return m.bk.Delete(uint64(id))
+}
+
+func (m *Manager) SetRedirectCode(id snowflake.ID, code int) error {
+	return m.Update(id, LinkUpdate{RedirectCode: &code})
+}
+
+func (m *Manager) Disable(id snowflake.ID) error {
+	if err := m.checkExists(id); err != nil {
+		return err
+	}
+	return m.bk.SetDisabled(uint64(id), true)
+}
+
+func (m *Manager) Enable(id snowflake.ID) error {
+	if err := m.checkExists(id); err != nil {
+		return err
+	}
+	return m.bk.SetDisabled(uint64(id), false)
+}
+
+func (m *Manager) Stats(id snowflake.ID) ([]HitCount, error) {
+	return m.bk.QueryHitCounts(uint64(id))
+}
+
+func (m *Manager) Info() (*BackendInfo, error) {
+	return m.bk.Info()
+}
+
+// Clean deletes all the expired links, see Sweeper for doing it in background
 func (m *Manager) Clean() error {
-	return m.bk.ClearExpired()
+	_, err := m.Sweep()
+	return err
+}
+
+// Sweep deletes all the expired links by batches, returns the number deleted
+func (m *Manager) Sweep() (int64, error) {
+	return sweepExpired(m.bk, cleanBatch, func() bool {
+		return true
+	})
 }
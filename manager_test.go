@@ -1,8 +1,11 @@
 package shorturl
 
 import (
+	"database/sql"
 	"github.com/bwmarrin/snowflake"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -114,3 +117,393 @@ func TestManager_General(t *testing.T) {
 		t.Fatal("should remains 4 rows.")
 	}
 }
+
+func TestManager_Alias(t *testing.T) {
+	bk := createBk(t)
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	id, err := mgr.InsertOrReuse("https://test.mrzm.io/sale", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	otherId, err := mgr.InsertOrReuse("https://test.mrzm.io/other", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if err = mgr.ReserveAlias("spring-sale", id); err != nil {
+		t.Fatal("failed on reserving alias.", err)
+	}
+	if err = mgr.ReserveAlias("spring-sale", id); err != nil {
+		t.Fatal("reserving the same alias again should be fine.", err)
+	}
+	if err = mgr.ReserveAlias("spring-sale", otherId); err == nil {
+		t.Fatal("should fail on collision")
+	}
+	for _, invalid := range []string{"", "ab", "-sale", "spring sale", "sale/1", "ünicode"} {
+		if err = mgr.ReserveAlias(invalid, otherId); err == nil {
+			t.Fatalf("should fail on invalid alias %q", invalid)
+		}
+	}
+	if err = mgr.ReserveAlias("nowhere", snowflake.ID(1)); err == nil {
+		t.Fatal("should fail on nonexistent id")
+	}
+	aliasedId, err := bk.QueryAlias("spring-sale")
+	if err != nil {
+		t.Fatal("failed on querying alias.", err)
+	}
+	if aliasedId != uint64(id) {
+		t.Fatal("alias not match")
+	}
+	if err = mgr.Delete(id); err != nil {
+		t.Fatal("failed on delete.", err)
+	}
+	aliasedId, err = bk.QueryAlias("spring-sale")
+	if err != nil {
+		t.Fatal("failed on querying alias.", err)
+	}
+	if aliasedId != 0 {
+		t.Fatal("alias should be removed with the entry")
+	}
+}
+
+func TestManager_InsertWithAlias(t *testing.T) {
+	bk := createBk(t)
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	id, err := mgr.InsertWithAlias("https://test.mrzm.io/launch", LinkOptions{}, "launch")
+	if err != nil {
+		t.Fatal("failed on insert with alias.", err)
+	}
+	if aliasedId, err := bk.QueryAlias("launch"); err != nil || aliasedId != uint64(id) {
+		t.Fatal("alias not match", aliasedId, err)
+	}
+	for _, alias := range []string{"launch", "-launch", "ab"} {
+		if _, err = mgr.InsertWithAlias("https://test.mrzm.io/orphan", LinkOptions{}, alias); err == nil {
+			t.Fatalf("should fail on alias %q", alias)
+		}
+	}
+	if existing, err := bk.QueryByUrl("https://test.mrzm.io/orphan"); err != nil || len(existing) != 0 {
+		t.Fatal("should insert nothing if the alias is refused", existing, err)
+	}
+}
+
+func TestManager_Disable(t *testing.T) {
+	bk := createBk(t)
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	id, err := mgr.InsertOrReuse("https://test.mrzm.io/disable", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if err = mgr.Disable(id); err != nil {
+		t.Fatal("failed on disable.", err)
+	}
+	entry, err := mgr.Query(id)
+	if err != nil {
+		t.Fatal("failed on query.", err)
+	}
+	if entry == nil || !entry.Disabled {
+		t.Fatal("should be disabled")
+	}
+	newId, err := mgr.InsertOrReuse("https://test.mrzm.io/disable", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if newId == id {
+		t.Fatal("should not reuse disabled id")
+	}
+	if err = mgr.Enable(id); err != nil {
+		t.Fatal("failed on enable.", err)
+	}
+	entry, err = mgr.Query(id)
+	if err != nil {
+		t.Fatal("failed on query.", err)
+	}
+	if entry == nil || entry.Disabled {
+		t.Fatal("should be enabled")
+	}
+	if err = mgr.Disable(id + 1); err == nil {
+		t.Fatal("should fail on disabling a link not found")
+	}
+	if err = mgr.Enable(id + 1); err == nil {
+		t.Fatal("should fail on enabling a link not found")
+	}
+}
+
+func TestManager_Retarget(t *testing.T) {
+	bk := createBk(t)
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	id, err := mgr.InsertOrReuse("https://test.mrzm.io/old", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if err = mgr.Retarget(id, "not a url"); err == nil {
+		t.Fatal("should fail on invalid url")
+	}
+	if err = mgr.Retarget(snowflake.ID(1), "https://test.mrzm.io/new"); err == nil {
+		t.Fatal("should fail on nonexistent id")
+	}
+	if err = mgr.Retarget(id, "https://test.mrzm.io/new"); err != nil {
+		t.Fatal("failed on retarget.", err)
+	}
+	expireAt := time.Now().Add(time.Hour).Unix()
+	if err = mgr.SetExpiry(id, expireAt); err != nil {
+		t.Fatal("failed on updating expiry.", err)
+	}
+	if err = mgr.SetExpiry(id, time.Now().Add(-time.Hour).Unix()); err == nil {
+		t.Fatal("should fail on expired time")
+	}
+	entry, err := mgr.Query(id)
+	if err != nil {
+		t.Fatal("failed on query.", err)
+	}
+	if entry.Url != "https://test.mrzm.io/new" || !entry.ExpireAt.Valid || entry.ExpireAt.Int64 != expireAt {
+		t.Fatal("entry not updated", entry)
+	}
+
+	newUrl, code, past := "https://test.mrzm.io/newer", 303, time.Now().Add(-time.Hour).Unix()
+	if err = mgr.Update(id, LinkUpdate{Url: &newUrl, RedirectCode: &code}); err == nil {
+		t.Fatal("should fail on invalid redirect code")
+	}
+	if err = mgr.Update(id, LinkUpdate{Url: &newUrl, ExpireAt: &past}); err == nil {
+		t.Fatal("should fail on expired time")
+	}
+	if entry, err = mgr.Query(id); err != nil || entry.Url != "https://test.mrzm.io/new" || entry.ExpireAt.Int64 != expireAt {
+		t.Fatal("should be unchanged by the invalid update", entry, err)
+	}
+	if err = mgr.Retarget(id, "https://test.mrzm.io/new"); err != nil {
+		t.Fatal("failed on retarget.", err)
+	}
+
+	history, err := mgr.History(id)
+	if err != nil {
+		t.Fatal("failed on querying history.", err)
+	}
+	if len(history) != 1 {
+		t.Fatal("should have 1 history entry, none for the expiry or the same url", history)
+	}
+	if history[0].Url != "https://test.mrzm.io/old" || history[0].ExpireAt.Valid {
+		t.Error("history should be the original target", history[0])
+	}
+
+	code = 308
+	if err = mgr.Update(id, LinkUpdate{Url: &newUrl, ExpireAt: new(int64), RedirectCode: &code}); err != nil {
+		t.Fatal("failed on update.", err)
+	}
+	if entry, err = mgr.Query(id); err != nil || entry.Url != newUrl || entry.ExpireAt.Valid || entry.RedirectCode != 308 {
+		t.Fatal("entry not updated", entry, err)
+	}
+	if history, err = mgr.History(id); err != nil || len(history) != 2 || history[1].Url != "https://test.mrzm.io/new" || history[1].ExpireAt.Int64 != expireAt {
+		t.Fatal("history should have the retargeted one with expiry", history, err)
+	}
+}
+
+func TestManager_ImportExport(t *testing.T) {
+	bk := createBk(t)
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	preassigned := mgr.snode.Generate().Base58()
+	otherNode, err := snowflake.NewNode(9)
+	if err != nil {
+		t.Fatal("failed on creating snowflake node.", err)
+	}
+	expireAt := time.Now().Add(time.Hour).Unix()
+	input := "url,id,expire_at,comment,disabled\n" +
+		"https://test.mrzm.io/import1,,,first\n" +
+		"https://test.mrzm.io/import2," + preassigned + "," + strconv.FormatInt(expireAt, 10) + ",,true\n" +
+		"not a url,,,\n" +
+		"https://test.mrzm.io/import3," + otherNode.Generate().Base58() + ",,\n" +
+		"https://test.mrzm.io/import4,,soon,\n" +
+		"https://test.mrzm.io/import5," + preassigned + ",,\n" +
+		"https://test.mrzm.io/import6,old-code,,\n" +
+		"https://test.mrzm.io/import7,old-code,,\n" +
+		"https://test.mrzm.io/import8,x,,\n"
+
+	var records []*BulkRecord
+	var lineErrs []int
+	err = ReadBulk(strings.NewReader(input), BulkCsv, func(rec *BulkRecord) error {
+		records = append(records, rec)
+		return nil
+	}, func(line int, err error) {
+		lineErrs = append(lineErrs, line)
+	})
+	if err != nil {
+		t.Fatal("failed on reading csv.", err)
+	}
+	if len(lineErrs) != 1 || lineErrs[0] != 6 {
+		t.Fatal("line 6 should be malformed", lineErrs)
+	}
+	results, err := mgr.ImportBatch(records)
+	if err != nil {
+		t.Fatal("failed on importing.", err)
+	}
+	for i, shouldFail := range []bool{false, false, true, false, true, false, true, true} {
+		if (results[i].Err != nil) != shouldFail {
+			t.Errorf("line %d: unexpected result %v", records[i].Line, results[i].Err)
+		}
+	}
+	// the codes of the other node & the other shortener are kept as aliases
+	for _, i := range []int{3, 5} {
+		if results[i].Alias != records[i].Id || results[i].Id.Node() != 0 {
+			t.Fatal("code should be kept as an alias", results[i])
+		}
+		if aliasedId, err := bk.QueryAlias(records[i].Id); err != nil || aliasedId != uint64(results[i].Id) {
+			t.Fatal("alias not match", aliasedId, err)
+		}
+	}
+	if existing, err := bk.QueryByUrl("https://test.mrzm.io/import7"); err != nil || len(existing) != 0 {
+		t.Fatal("link of the alias taken should not be imported", existing, err)
+	}
+	id, _ := snowflake.ParseBase58([]byte(preassigned))
+	entry, err := mgr.Query(id)
+	if err != nil || entry == nil || entry.Url != "https://test.mrzm.io/import2" || entry.ExpireAt.Int64 != expireAt || !entry.Disabled {
+		t.Fatal("preassigned id not imported.", err)
+	}
+	expired := &UrlEntry{Id: uint64(mgr.snode.Generate()), Url: "https://test.mrzm.io/expired", ExpireAt: sql.NullInt64{Int64: time.Now().Unix() - 1, Valid: true}}
+	if err = bk.InsertUrl(expired); err != nil {
+		t.Fatal("failed on inserting expired link.", err)
+	}
+
+	var out strings.Builder
+	bw, err := NewBulkWriter(&out, BulkJsonl)
+	if err != nil {
+		t.Fatal("failed on creating writer.", err)
+	}
+	if err = mgr.Export(bw.Write); err != nil {
+		t.Fatal("failed on exporting.", err)
+	}
+	if err = bw.Flush(); err != nil {
+		t.Fatal("failed on flushing.", err)
+	}
+
+	// round trip into another node
+	memBk, err := MemoryOpen(0)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	memMgr, err := NewManager(memBk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	records = nil
+	err = ReadBulk(strings.NewReader(out.String()), BulkJsonl, func(rec *BulkRecord) error {
+		records = append(records, rec)
+		return nil
+	}, func(line int, err error) {
+		t.Error("unexpected malformed line", line, err)
+	})
+	if err != nil {
+		t.Fatal("failed on reading jsonl.", err)
+	}
+	if len(records) != 4 {
+		t.Fatal("should export 4 links", out.String())
+	}
+	if results, err = memMgr.ImportBatch(records); err != nil {
+		t.Fatal("failed on importing.", err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Error("failed on importing exported links.", result.Err)
+		}
+	}
+	if entry, err = memMgr.Query(id); err != nil || entry == nil || entry.Url != "https://test.mrzm.io/import2" || !entry.Disabled {
+		t.Fatal("exported link not imported.", err)
+	}
+
+	out.Reset()
+	if bw, err = NewBulkWriter(&out, BulkCsv); err != nil {
+		t.Fatal("failed on creating writer.", err)
+	}
+	if err = bw.Write(entry); err != nil || bw.Flush() != nil {
+		t.Fatal("failed on writing csv.", err)
+	}
+	err = ReadBulk(strings.NewReader(out.String()), BulkCsv, func(rec *BulkRecord) error {
+		if rec.Id != preassigned || !rec.Disabled || rec.ExpireAt != expireAt {
+			t.Error("csv record not match", rec)
+		}
+		return nil
+	}, func(line int, err error) {
+		t.Error("unexpected malformed line", line, err)
+	})
+	if err != nil {
+		t.Fatal("failed on reading csv.", err)
+	}
+}
+
+func TestManager_RedirectCode(t *testing.T) {
+	bk := createBk(t)
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	id, err := mgr.InsertOrReuse("https://test.mrzm.io/code", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	sameId, err := mgr.InsertOrReuseWithOptions("https://test.mrzm.io/code", LinkOptions{ExpireAt: -1, RedirectCode: 302})
+	if err != nil || sameId != id {
+		t.Fatal("should reuse the default 302 link.", err)
+	}
+	if sameId, err = mgr.InsertOrReuseWithOptions("https://test.mrzm.io/code", LinkOptions{}); err != nil || sameId != id {
+		t.Fatal("should reuse the never expiring link by the zero options.", err)
+	}
+	if sameId, err = mgr.InsertOrReuse("https://test.mrzm.io/code", 0); err != nil || sameId != id {
+		t.Fatal("should reuse the never expiring link by 0.", err)
+	}
+	permanentId, err := mgr.InsertOrReuseWithOptions("https://test.mrzm.io/code", LinkOptions{ExpireAt: -1, RedirectCode: 301})
+	if err != nil || permanentId == id {
+		t.Fatal("should not reuse the link with another code.", err)
+	}
+	if err = mgr.SetRedirectCode(id, 308); err != nil {
+		t.Fatal("failed on setting code.", err)
+	}
+	if err = mgr.SetRedirectCode(id, 200); err == nil {
+		t.Fatal("should fail on unsupported code")
+	}
+	entry, err := mgr.Query(id)
+	if err != nil || entry.RedirectCode != 308 {
+		t.Fatal("code not updated.", err)
+	}
+}
+
+func TestManager_List(t *testing.T) {
+	bk := createBk(t)
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	since := time.Now()
+	id, err := mgr.InsertOrReuse("https://test.mrzm.io/list", -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	created := time.UnixMilli(id.Time())
+	if uint64(id) < IdAt(created) || uint64(id) >= IdAt(created.Add(time.Millisecond)) || IdAt(time.Unix(0, 0)) != 0 {
+		t.Fatal("id of the creation time not match", id, IdAt(created))
+	}
+	if entries, err := mgr.List(LinkFilter{MinId: IdAt(since), State: ActiveState}); err != nil || len(entries) != 1 || entries[0].Id != uint64(id) {
+		t.Fatal("should list the link created since.", entries, err)
+	}
+	if entries, err := mgr.List(LinkFilter{MinId: IdAt(time.Now().Add(time.Second))}); err != nil || len(entries) != 0 {
+		t.Fatal("should not list the link created before.", entries, err)
+	}
+	for _, name := range []string{"all", "active", "expired", "disabled", "pending"} {
+		if state, err := ParseLinkState(name); err != nil || state.String() != name {
+			t.Error("state not match", name, state, err)
+		}
+	}
+	if _, err = ParseLinkState("gone"); err == nil {
+		t.Error("should refuse unknown state")
+	}
+}
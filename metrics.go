@@ -0,0 +1,173 @@
+package shorturl
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the upper bounds of the backend query latency histogram, in seconds
+var queryBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Metrics counts the requests & backend queries of a Redirecter, exposed in
+// the Prometheus text format by its ServeHTTP.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[metricKey]int64
+	queries  map[metricKey]*histogram
+	cache    func() (CacheStats, bool)
+	backends func() []Backend
+}
+
+// metricKey is the labels, node is empty if the request is not resolved to a node
+type metricKey struct {
+	node   string
+	result string
+}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  int64
+}
+
+func newMetrics(cache func() (CacheStats, bool), backends func() []Backend) *Metrics {
+	return &Metrics{
+		requests: make(map[metricKey]int64),
+		queries:  make(map[metricKey]*histogram),
+		cache:    cache,
+		backends: backends,
+	}
+}
+
+func nodeLabel(nodeId int64) string {
+	if nodeId < 0 {
+		return ""
+	}
+	return strconv.FormatInt(nodeId, 10)
+}
+
+// requestResult names the result of a request by its status
+func requestResult(status int) string {
+	switch {
+	case status == 301 || status == 302 || status == 307 || status == 308:
+		return "redirect"
+	case status == 200:
+		return "page"
+	case status == 204:
+		return "options"
+	case status == 303:
+		return "unlocked"
+	case status == 400:
+		return "bad_request"
+	case status == 401:
+		return "password"
+	case status == 404:
+		return "not_found"
+	case status == 405:
+		return "method_not_allowed"
+	case status == 410:
+		return "gone"
+	case status >= 500:
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
+
+func (m *Metrics) observeRequest(nodeId int64, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[metricKey{nodeLabel(nodeId), requestResult(status)}]++
+}
+
+// observeQuery records a QueryById of the node, result is found, not_found or error
+func (m *Metrics) observeQuery(nodeId int64, result string, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey{nodeLabel(nodeId), result}
+	h, ok := m.queries[key]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(queryBuckets)+1)}
+		m.queries[key] = h
+	}
+	seconds := elapsed.Seconds()
+	i := sort.SearchFloat64s(queryBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+func sortedKeys[V any](m map[metricKey]V) []metricKey {
+	keys := make([]metricKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].node != keys[j].node {
+			return keys[i].node < keys[j].node
+		}
+		return keys[i].result < keys[j].result
+	})
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+	m.write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = io.WriteString(w, b.String())
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	_, _ = fmt.Fprintln(w, "# HELP surl_requests_total Requests served by the redirecter, by the node resolved & the result.")
+	_, _ = fmt.Fprintln(w, "# TYPE surl_requests_total counter")
+	for _, k := range sortedKeys(m.requests) {
+		_, _ = fmt.Fprintf(w, "surl_requests_total{node=%q,result=%q} %d\n", k.node, k.result, m.requests[k])
+	}
+	_, _ = fmt.Fprintln(w, "# HELP surl_backend_query_duration_seconds Latency of looking links up by id in the backend of each node.")
+	_, _ = fmt.Fprintln(w, "# TYPE surl_backend_query_duration_seconds histogram")
+	for _, k := range sortedKeys(m.queries) {
+		h := m.queries[k]
+		cumulative := int64(0)
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(queryBuckets) {
+				le = formatFloat(queryBuckets[i])
+			}
+			_, _ = fmt.Fprintf(w, "surl_backend_query_duration_seconds_bucket{node=%q,result=%q,le=%q} %d\n", k.node, k.result, le, cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "surl_backend_query_duration_seconds_sum{node=%q,result=%q} %s\n", k.node, k.result, formatFloat(h.sum))
+		_, _ = fmt.Fprintf(w, "surl_backend_query_duration_seconds_count{node=%q,result=%q} %d\n", k.node, k.result, h.count)
+	}
+	m.mu.Unlock()
+
+	_, _ = fmt.Fprintln(w, "# HELP surl_backends Backends attached.")
+	_, _ = fmt.Fprintln(w, "# TYPE surl_backends gauge")
+	_, _ = fmt.Fprintf(w, "surl_backends %d\n", len(m.backends()))
+	stats, ok := m.cache()
+	if !ok {
+		return
+	}
+	for _, metric := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"surl_cache_hits_total", "counter", "Lookups served by the cache.", stats.Hits},
+		{"surl_cache_misses_total", "counter", "Lookups missing the cache, incl. the expired entries.", stats.Misses},
+		{"surl_cache_evictions_total", "counter", "Entries evicted for the size limit before expiring.", stats.Evictions},
+		{"surl_cache_entries", "gauge", "Entries in the cache.", int64(stats.Entries)},
+	} {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
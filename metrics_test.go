@@ -0,0 +1,48 @@
+package shorturl
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirecter_Metrics(t *testing.T) {
+	redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/metrics", 4)
+	dst := "https://example.mrzm.io/" + randStr(18)
+	id, err := mgr.InsertOrReuse(dst, -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	for i := 0; i < 2; i++ { // the 2nd one is served from the cache
+		check302("GET", "https://r.mrzm.io/metrics/"+id.Base58(), dst, redirecter, t)
+	}
+	check404("GET", "https://r.mrzm.io/metrics/nothing", redirecter, t)
+	checkStatus("POST", "https://r.mrzm.io/metrics/"+id.Base58(), 405, redirecter, t)
+
+	rr := httptest.NewRecorder()
+	redirecter.Metrics().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("content type not match", rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	for _, line := range []string{
+		"# TYPE surl_requests_total counter",
+		`surl_requests_total{node="4",result="redirect"} 2`,
+		`surl_requests_total{node="4",result="method_not_allowed"} 1`,
+		`surl_requests_total{node="",result="not_found"} 1`,
+		"# TYPE surl_backend_query_duration_seconds histogram",
+		`surl_backend_query_duration_seconds_bucket{node="4",result="found",le="+Inf"} 1`,
+		`surl_backend_query_duration_seconds_count{node="4",result="found"} 1`,
+		"surl_backends 1",
+		"surl_cache_hits_total 2",
+		"surl_cache_misses_total 2",
+		"surl_cache_entries 2",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("metric not found:", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
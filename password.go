@@ -0,0 +1,185 @@
+package shorturl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	passwordIterations = 100000
+	passwordSaltLen    = 16
+	passwordCookieTtl  = time.Hour
+)
+
+// HashPassword returns the salted PBKDF2-SHA256 hash of password, as
+// pbkdf2-sha256$<iterations>$<salt>$<hash> with unpadded base64
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2Sha256([]byte(password), salt, passwordIterations, sha256.Size)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func parsePasswordHash(hash string) (iterations int, salt []byte, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, fmt.Errorf("unknown password hash format")
+	}
+	if iterations, err = strconv.Atoi(parts[1]); err != nil || iterations <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid iterations in password hash")
+	}
+	enc := base64.RawStdEncoding
+	if salt, err = enc.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid salt in password hash")
+	}
+	if key, err = enc.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid key in password hash")
+	}
+	return iterations, salt, key, nil
+}
+
+// ValidatePasswordHash checks hash is in the format of HashPassword, e.g. when importing
+func ValidatePasswordHash(hash string) error {
+	_, _, _, err := parsePasswordHash(hash)
+	return err
+}
+
+func verifyPassword(hash string, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2Sha256([]byte(password), salt, iterations, len(key)), key) == 1
+}
+
+// pbkdf2Sha256 is PBKDF2 of RFC 8018 with HMAC-SHA256
+func pbkdf2Sha256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	u := make([]byte, 0, sha256.Size)
+	block := make([]byte, sha256.Size)
+	for i := uint32(1); len(key) < keyLen; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, i))
+		u = prf.Sum(u[:0])
+		copy(block, u)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range block {
+				block[j] ^= u[j]
+			}
+		}
+		key = append(key, block...)
+	}
+	return key[:keyLen]
+}
+
+// passwordCookieName is per link, so unlocking one link does not unlock the others
+func passwordCookieName(id uint64) string {
+	return "surl_pw_" + strconv.FormatUint(id, 36)
+}
+
+// signPasswordCookie returns <expiry>.<mac>, the mac covers the password hash
+// so changing the password invalidates the cookies issued before
+func signPasswordCookie(secret []byte, entry *UrlEntry, expireAt int64) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%d|%d|%s", entry.Id, expireAt, entry.PasswordHash)
+	return strconv.FormatInt(expireAt, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyPasswordCookie(secret []byte, entry *UrlEntry, value string) bool {
+	expiry, _, found := strings.Cut(value, ".")
+	if !found {
+		return false
+	}
+	expireAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || expireAt < time.Now().Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(signPasswordCookie(secret, entry, expireAt)), []byte(value))
+}
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+</head>
+<body>
+<form method="post">
+<p>This link is protected by a password.</p>
+{{if .}}<p>{{.}}</p>
+{{end}}<input type="password" name="password" autofocus required>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+func (r *Redirecter) unlocked(req *http.Request, entry *UrlEntry) bool {
+	cookie, err := req.Cookie(passwordCookieName(entry.Id))
+	return err == nil && verifyPasswordCookie(r.secret, entry, cookie.Value)
+}
+
+// servePassword renders the password form, or verifies the submitted one and
+// sets the cookie, then sends the browser back to the short link
+func (r *Redirecter) servePassword(w http.ResponseWriter, req *http.Request, entry *UrlEntry) {
+	w.Header().Set("Cache-Control", "no-store")
+	message := ""
+	if req.Method == "POST" {
+		req.Body = http.MaxBytesReader(w, req.Body, 4096)
+		password := req.PostFormValue("password")
+		// PBKDF2 is costly on purpose, the attempts beyond the CPUs are refused
+		// rather than letting the unauthenticated posts take the server down
+		select {
+		case r.verifying <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			_, _ = io.WriteString(w, "too many attempts, please retry later")
+			return
+		}
+		ok := verifyPassword(entry.PasswordHash, password)
+		<-r.verifying
+		if ok {
+			expireAt := time.Now().Add(passwordCookieTtl)
+			http.SetCookie(w, &http.Cookie{
+				Name:     passwordCookieName(entry.Id),
+				Value:    signPasswordCookie(r.secret, entry, expireAt.Unix()),
+				Path:     r.baseUrl.Path,
+				Expires:  expireAt,
+				MaxAge:   int(passwordCookieTtl.Seconds()),
+				Secure:   r.baseUrl.Scheme == "https",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, req, req.URL.RequestURI(), 303)
+			return
+		}
+		message = "Wrong password, please try again."
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(401)
+	if err := passwordTemplate.Execute(w, message); err != nil {
+		log.Printf("failed on rendering password form: %v", err)
+	}
+}
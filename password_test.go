@@ -0,0 +1,115 @@
+package shorturl
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPbkdf2Sha256(t *testing.T) {
+	// RFC 7914, section 11
+	key := pbkdf2Sha256([]byte("passwd"), []byte("salt"), 1, 64)
+	if hex.EncodeToString(key) != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783" {
+		t.Error("derived key not match", hex.EncodeToString(key))
+	}
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal("failed on hashing.", err)
+	}
+	if ValidatePasswordHash(hash) != nil || !verifyPassword(hash, "s3cret") || verifyPassword(hash, "s3cret ") {
+		t.Error("password not verified")
+	}
+	if another, _ := HashPassword("s3cret"); another == hash {
+		t.Error("hashes should be salted")
+	}
+	if ValidatePasswordHash("plain") == nil || verifyPassword("plain", "plain") {
+		t.Error("should refuse invalid hash")
+	}
+}
+
+func TestRedirecter_Password(t *testing.T) {
+	redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/pw", 0)
+	dst := "https://example.mrzm.io/" + randStr(18)
+	public, err := mgr.InsertOrReuse(dst, -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	id, err := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, Password: "s3cret"})
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if id == public {
+		t.Fatal("protected link should not reuse the public one")
+	}
+	if reused, _ := mgr.InsertOrReuse(dst, -1); reused != public {
+		t.Fatal("public link should not reuse the protected one")
+	}
+	reqUrl := "https://r.mrzm.io/pw/" + id.Base58()
+
+	for i := 0; i < 2; i++ { // the 2nd one is served from the cache
+		checkStatus("GET", reqUrl, 401, redirecter, t)
+	}
+	post := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", reqUrl, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := post("wrong"); rr.Code != 401 || len(rr.Result().Cookies()) != 0 {
+		t.Fatal("wrong password should be refused", rr.Code)
+	}
+	for i := 0; i < cap(redirecter.verifying); i++ {
+		redirecter.verifying <- struct{}{}
+	}
+	if rr := post("s3cret"); rr.Code != 503 || rr.Header().Get("Retry-After") == "" || len(rr.Result().Cookies()) != 0 {
+		t.Fatal("should refuse once the verifications are saturated", rr.Code)
+	}
+	for i := 0; i < cap(redirecter.verifying); i++ {
+		<-redirecter.verifying
+	}
+	rr := post("s3cret")
+	if rr.Code != 303 || rr.Header().Get("Location") != "/pw/"+id.Base58() {
+		t.Fatal("should redirect back to the short link", rr.Code, rr.Header().Get("Location"))
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatal("cookie not set", cookies)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", reqUrl, nil)
+		req.AddCookie(cookies[0])
+		rr = httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, req)
+		if rr.Code != 302 || rr.Header().Get("Location") != dst || rr.Header().Get("Cache-Control") != "private, no-store" {
+			t.Fatal("should redirect with the cookie", rr.Code)
+		}
+	}
+
+	// neither the tampered cookies nor the ones signed by the old secret unlock
+	tampered := *cookies[0]
+	tampered.Value = strings.Replace(tampered.Value, ".", "9.", 1)
+	for _, cookie := range []*http.Cookie{&tampered, cookies[0]} {
+		req := httptest.NewRequest("GET", reqUrl, nil)
+		req.AddCookie(cookie)
+		rr = httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, req)
+		if rr.Code != 401 {
+			t.Error("should not be unlocked", rr.Code)
+		}
+		redirecter.SetCookieSecret([]byte("rotated"))
+	}
+
+	req := httptest.NewRequest("GET", reqUrl+"+", nil)
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	redirecter.ServeHTTP(rr, req)
+	if rr.Code != 200 || strings.Contains(rr.Body.String(), dst) || !strings.Contains(rr.Body.String(), `"protected":true`) {
+		t.Error("info page should hide the destination", rr.Body.String())
+	}
+	check302("GET", "https://r.mrzm.io/pw/"+public.Base58(), dst, redirecter, t)
+}
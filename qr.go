@@ -0,0 +1,510 @@
+package shorturl
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// QrLevel is the error correction level of QR codes
+type QrLevel int
+
+const (
+	QrLow      QrLevel = iota // ~7% recoverable
+	QrMedium                  // ~15%
+	QrQuartile                // ~25%
+	QrHigh                    // ~30%
+)
+
+const qrQuietZone = 4
+
+func ParseQrLevel(level string) (QrLevel, error) {
+	switch strings.ToUpper(level) {
+	case "L":
+		return QrLow, nil
+	case "M", "":
+		return QrMedium, nil
+	case "Q":
+		return QrQuartile, nil
+	case "H":
+		return QrHigh, nil
+	}
+	return 0, fmt.Errorf("unknown error correction level %q, L, M, Q or H expected", level)
+}
+
+// indexed by level & version, version 0 unused
+var qrEccPerBlock = [4][41]int{
+	{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var qrEccBlocks = [4][41]int{
+	{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// format bits of the levels, which are not in the order of recoverability
+var qrLevelBits = [4]int{1, 0, 3, 2}
+
+// QrCode is an encoded QR symbol, modules are indexed by [y][x], true for dark
+type QrCode struct {
+	Version  int
+	Size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// qrRawCodewords is the count of codewords a version holds, excluding the function patterns
+func qrRawCodewords(version int) int {
+	modules := (16*version+128)*version + 64
+	if version >= 2 {
+		aligns := version/7 + 2
+		modules -= (25*aligns-10)*aligns - 55
+		if version >= 7 {
+			modules -= 36
+		}
+	}
+	return modules / 8
+}
+
+func qrDataCodewords(version int, level QrLevel) int {
+	return qrRawCodewords(version) - qrEccPerBlock[level][version]*qrEccBlocks[level][version]
+}
+
+// EncodeQr encodes data in byte mode with the smallest version fitting
+func EncodeQr(data []byte, level QrLevel) (*QrCode, error) {
+	if level < QrLow || level > QrHigh {
+		return nil, fmt.Errorf("invalid error correction level %d", level)
+	}
+	version := 1
+	for ; version <= 40; version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if len(data) < 1<<countBits && 4+countBits+len(data)*8 <= qrDataCodewords(version, level)*8 {
+			break
+		}
+	}
+	if version > 40 {
+		return nil, fmt.Errorf("%d bytes are too long for a QR code", len(data))
+	}
+
+	capacity := qrDataCodewords(version, level)
+	var bits qrBits
+	bits.append(0x4, 4) // byte mode
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, capacity*8-bits.len))
+	bits.append(0, (8-bits.len%8)%8)
+	for pad := 0xEC; bits.len < capacity*8; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	q := &QrCode{Version: version, Size: version*4 + 17}
+	q.modules = make([][]bool, q.Size)
+	q.function = make([][]bool, q.Size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.Size)
+		q.function[y] = make([]bool, q.Size)
+	}
+	q.drawFunctionPatterns()
+	q.drawFormatBits(level, 0) // reserves the area before placing data
+	q.drawCodewords(qrInterleave(bits.bytes, version, level))
+
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // XOR again to undo
+	}
+	q.applyMask(bestMask)
+	q.drawFormatBits(level, bestMask)
+	return q, nil
+}
+
+// Dark reports whether the module at (x, y) is dark, out of range ones are light
+func (q *QrCode) Dark(x int, y int) bool {
+	return x >= 0 && y >= 0 && x < q.Size && y < q.Size && q.modules[y][x]
+}
+
+type qrBits struct {
+	bytes []byte
+	len   int
+}
+
+func (b *qrBits) append(value int, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if b.len%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if value>>i&1 != 0 {
+			b.bytes[b.len/8] |= 0x80 >> (b.len % 8)
+		}
+		b.len++
+	}
+}
+
+func (q *QrCode) setFunction(x int, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *QrCode) drawFunctionPatterns() {
+	for i := 0; i < q.Size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(q.Size-4, 3)
+	q.drawFinder(3, q.Size-4)
+
+	aligns := qrAlignmentPositions(q.Version)
+	for i, x := range aligns {
+		for j, y := range aligns {
+			// skip the ones overlapping the finders
+			if (i == 0 && j == 0) || (i == 0 && j == len(aligns)-1) || (i == len(aligns)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	if q.Version >= 7 {
+		bits := qrVersionBits(q.Version)
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 != 0
+			a, b := q.Size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+// qrVersionBits returns the 18 bits BCH code of the version, for versions >= 7
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	return version<<12 | rem
+}
+
+// drawFinder draws a finder pattern with its separator, centered at (x, y)
+func (q *QrCode) drawFinder(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= q.Size || yy >= q.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			q.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	count := version/7 + 2
+	step := (version*8 + count*3 + 5) / (count*4 - 4) * 2
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, version*4+10; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// qrFormatBits returns the 15 bits BCH code of the level & mask
+func qrFormatBits(level QrLevel, mask int) int {
+	data := qrLevelBits[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *QrCode) drawFormatBits(level QrLevel, mask int) {
+	bits := qrFormatBits(level, mask)
+	bit := func(i int) bool {
+		return bits>>i&1 != 0
+	}
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.Size-15+i, bit(i))
+	}
+	q.setFunction(8, q.Size-8, true)
+}
+
+// qrInterleave splits data into blocks, appends the error correction codewords of each & interleaves them
+func qrInterleave(data []byte, version int, level QrLevel) []byte {
+	blocks := qrEccBlocks[level][version]
+	eccLen := qrEccPerBlock[level][version]
+	raw := qrRawCodewords(version)
+	shortBlocks := blocks - raw%blocks
+	shortLen := raw/blocks - eccLen
+
+	generator := qrGenerator(eccLen)
+	dataBlocks := make([][]byte, blocks)
+	eccBlocks := make([][]byte, blocks)
+	offset := 0
+	for i := range dataBlocks {
+		n := shortLen
+		if i >= shortBlocks {
+			n++
+		}
+		dataBlocks[i] = data[offset : offset+n]
+		eccBlocks[i] = qrRemainder(dataBlocks[i], generator)
+		offset += n
+	}
+
+	result := make([]byte, 0, raw)
+	for i := 0; i <= shortLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func qrMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrGenerator returns the coefficients of the Reed-Solomon generator polynomial
+// of the degree, excluding the leading 1, highest power first
+func qrGenerator(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+func qrRemainder(data []byte, generator []byte) []byte {
+	result := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range generator {
+			result[i] ^= qrMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// drawCodewords places the bits in the zigzag order, from the bottom right corner
+func (q *QrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i/8]>>(7-i%8)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *QrCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+var qrFinderLike = [2][11]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// penalty scores the symbol by the rules of ISO/IEC 18004, lower is better
+func (q *QrCode) penalty() int {
+	result, dark := 0, 0
+	for _, vertical := range []bool{false, true} {
+		at := func(i int, j int) bool {
+			if vertical {
+				return q.Dark(i, j)
+			}
+			return q.Dark(j, i)
+		}
+		for i := 0; i < q.Size; i++ {
+			run := 0
+			for j := 0; j < q.Size; j++ {
+				if j > 0 && at(i, j) == at(i, j-1) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					result += 3
+				} else if run > 5 {
+					result++
+				}
+			}
+			for j := 0; j+11 <= q.Size; j++ {
+				for _, pattern := range qrFinderLike {
+					matched := true
+					for k, v := range pattern {
+						if at(i, j+k) != v {
+							matched = false
+							break
+						}
+					}
+					if matched {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && q.modules[y][x] == q.modules[y-1][x] && q.modules[y][x] == q.modules[y][x-1] && q.modules[y][x] == q.modules[y-1][x-1] {
+				result += 3
+			}
+		}
+	}
+	total := q.Size * q.Size
+	result += abs(dark*20-total*10) / total * 10
+	return result
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// scale returns the pixels per module fitting size, the quiet zone included
+func (q *QrCode) scale(size int) int {
+	return max(1, size/(q.Size+qrQuietZone*2))
+}
+
+// WritePng renders the symbol with the quiet zone, as large as fitting size pixels
+func (q *QrCode) WritePng(w io.Writer, size int) error {
+	scale := q.scale(size)
+	width := (q.Size + qrQuietZone*2) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < width; y++ {
+		for x := 0; x < width; x++ {
+			if q.Dark(x/scale-qrQuietZone, y/scale-qrQuietZone) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// WriteSvg renders the symbol with the quiet zone, size is the width & height in pixels
+func (q *QrCode) WriteSvg(w io.Writer, size int) error {
+	bw := bufio.NewWriter(w)
+	width := q.Size + qrQuietZone*2
+	_, _ = fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", size, size, width, width)
+	_, _ = fmt.Fprintf(bw, `<rect width="100%%" height="100%%" fill="#FFFFFF"/>`+"\n"+`<path fill="#000000" d="`)
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				_, _ = fmt.Fprintf(bw, "M%d,%dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	_, _ = io.WriteString(bw, "\"/>\n</svg>\n")
+	return bw.Flush()
+}
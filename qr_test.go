@@ -0,0 +1,214 @@
+package shorturl
+
+import (
+	"bytes"
+	"image/png"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestQr_Vectors(t *testing.T) {
+	// "HELLO WORLD" in 1-M, from the ISO/IEC 18004 walkthroughs
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ecc := qrRemainder(data, qrGenerator(10))
+	if !slices.Equal(ecc, []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}) {
+		t.Error("error correction codewords not match", ecc)
+	}
+	if bits := qrFormatBits(QrLow, 4); bits != 0b110011000101111 {
+		t.Errorf("format bits of L4 not match, got %015b", bits)
+	}
+	if bits := qrFormatBits(QrMedium, 0); bits != 0b101010000010010 {
+		t.Errorf("format bits of M0 not match, got %015b", bits)
+	}
+	if bits := qrVersionBits(7); bits != 0x07C94 {
+		t.Errorf("version bits of 7 not match, got %x", bits)
+	}
+	if aligns := qrAlignmentPositions(32); !slices.Equal(aligns, []int{6, 34, 60, 86, 112, 138}) {
+		t.Error("alignment positions of 32 not match", aligns)
+	}
+	for _, c := range []struct {
+		version int
+		level   QrLevel
+		data    int
+	}{{1, QrLow, 19}, {1, QrHigh, 9}, {5, QrQuartile, 62}, {10, QrMedium, 216}, {40, QrLow, 2956}, {40, QrHigh, 1276}} {
+		if got := qrDataCodewords(c.version, c.level); got != c.data {
+			t.Error("data capacity not match", c, got)
+		}
+	}
+}
+
+// qrRead decodes the symbol back into the data codewords, verifying the error correction codewords
+func qrRead(t *testing.T, q *QrCode) []byte {
+	bits := 0
+	for i := 0; i <= 5; i++ {
+		if q.modules[i][8] {
+			bits |= 1 << i
+		}
+	}
+	for i, xy := range [][2]int{{8, 7}, {8, 8}, {7, 8}} {
+		if q.modules[xy[1]][xy[0]] {
+			bits |= 1 << (i + 6)
+		}
+	}
+	for i := 9; i < 15; i++ {
+		if q.modules[8][14-i] {
+			bits |= 1 << i
+		}
+	}
+	level, mask := QrLevel(-1), -1
+	for l := QrLow; l <= QrHigh; l++ {
+		for m := 0; m < 8; m++ {
+			if qrFormatBits(l, m) == bits {
+				level, mask = l, m
+			}
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("invalid format bits %015b", bits)
+	}
+
+	q.applyMask(mask)
+	defer q.applyMask(mask)
+	var raw []byte
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if q.function[y][x] || i >= qrRawCodewords(q.Version)*8 {
+					continue
+				}
+				if i%8 == 0 {
+					raw = append(raw, 0)
+				}
+				if q.modules[y][x] {
+					raw[i/8] |= 0x80 >> (i % 8)
+				}
+				i++
+			}
+		}
+	}
+
+	blocks := qrEccBlocks[level][q.Version]
+	eccLen := qrEccPerBlock[level][q.Version]
+	shortBlocks := blocks - len(raw)%blocks
+	shortLen := len(raw)/blocks - eccLen
+	codewords := make([][]byte, blocks)
+	offset := 0
+	for k := 0; k <= shortLen; k++ {
+		for b := range codewords {
+			if k < shortLen || b >= shortBlocks {
+				codewords[b] = append(codewords[b], raw[offset])
+				offset++
+			}
+		}
+	}
+	for k := 0; k < eccLen; k++ {
+		for b := range codewords {
+			codewords[b] = append(codewords[b], raw[offset])
+			offset++
+		}
+	}
+	var data []byte
+	for _, block := range codewords {
+		if rem := qrRemainder(block, qrGenerator(eccLen)); slices.ContainsFunc(rem, func(b byte) bool { return b != 0 }) {
+			t.Fatal("error correction codewords not match")
+		}
+		data = append(data, block[:len(block)-eccLen]...)
+	}
+	return data
+}
+
+func TestQr_Encode(t *testing.T) {
+	for _, level := range []QrLevel{QrLow, QrMedium, QrQuartile, QrHigh} {
+		for _, n := range []int{1, 17, 30, 100, 300, 1200} {
+			text := []byte(strings.Repeat("https://r.mrzm.io/", n)[:n])
+			q, err := EncodeQr(text, level)
+			if err != nil {
+				t.Fatal("failed on encoding.", err)
+			}
+			if q.Size != q.Version*4+17 {
+				t.Fatal("size not match")
+			}
+			data := qrRead(t, q)
+			header := 2
+			if q.Version >= 10 {
+				header = 3
+			}
+			// mode & count are 12 or 20 bits, the data bytes are shifted by 4 bits
+			decoded := make([]byte, len(text))
+			for i := range decoded {
+				decoded[i] = data[header+i-1]<<4 | data[header+i]>>4
+			}
+			if data[0]>>4 != 0x4 || !bytes.Equal(decoded, text) {
+				t.Error("data not match", level, n)
+			}
+		}
+	}
+	if _, err := EncodeQr(make([]byte, 3000), QrLow); err == nil {
+		t.Error("should be too long")
+	}
+	if _, err := ParseQrLevel("X"); err == nil {
+		t.Error("should fail on unknown level")
+	}
+}
+
+func TestRedirecter_Qr(t *testing.T) {
+	redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/qr", 0)
+	id, err := mgr.InsertOrReuse("https://example.mrzm.io/"+randStr(18), -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+
+	req := httptest.NewRequest("GET", "https://r.mrzm.io/qr/"+id.Base58()+".png?size=300&ec=H", nil)
+	rr := httptest.NewRecorder()
+	redirecter.ServeHTTP(rr, req)
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "image/png" {
+		t.Fatal("png not served", rr.Code)
+	}
+	img, err := png.Decode(rr.Body)
+	if err != nil {
+		t.Fatal("failed on decoding png.", err)
+	}
+	if width := img.Bounds().Dx(); width > 300 || width < 150 {
+		t.Error("png size not match", width)
+	}
+
+	req = httptest.NewRequest("GET", "https://r.mrzm.io/qr/"+id.Base58()+".svg", nil)
+	rr = httptest.NewRecorder()
+	redirecter.ServeHTTP(rr, req)
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "image/svg+xml" || !strings.Contains(rr.Body.String(), `width="256"`) {
+		t.Error("svg not served", rr.Code)
+	}
+
+	checkStatus("GET", "https://r.mrzm.io/qr/"+id.Base58()+".png?size=0", 400, redirecter, t)
+	checkStatus("GET", "https://r.mrzm.io/qr/"+id.Base58()+".png?ec=X", 400, redirecter, t)
+	check404("GET", "https://r.mrzm.io/qr/nothing.png", redirecter, t)
+	check404("GET", "https://r.mrzm.io/qr/.png", redirecter, t)
+}
+
+func TestShortUrl(t *testing.T) {
+	for baseUrl, expected := range map[string]string{
+		"https://r.mrzm.io":     "https://r.mrzm.io/2j9C3KH7ZsY",
+		"https://r.mrzm.io/qr":  "https://r.mrzm.io/qr/2j9C3KH7ZsY",
+		"https://r.mrzm.io/qr/": "https://r.mrzm.io/qr/2j9C3KH7ZsY",
+	} {
+		parsed, err := ParseBaseUrl(baseUrl)
+		if err != nil || ShortUrl(parsed, "2j9C3KH7ZsY") != expected {
+			t.Error("short url not match", baseUrl, err)
+		}
+	}
+	for _, baseUrl := range []string{"", "r.mrzm.io", "/qr"} {
+		if _, err := ParseBaseUrl(baseUrl); err == nil {
+			t.Error("should refuse base url", baseUrl)
+		}
+	}
+}
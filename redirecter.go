@@ -1,26 +1,46 @@
 package shorturl
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/snowflake"
 	"github.com/fsnotify/fsnotify"
-	"github.com/patrickmn/go-cache"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"net/url"
 	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 func NewRedirecter(files []string, baseUrl string, strict bool, enableCache bool) (*Redirecter, error) {
-	bks := make(map[int64]Backend)
+	var bks []Backend
 	for _, f := range files {
-		bk, err := SqliteOpen(f, false, 0)
+		bk, err := OpenBackend(f, false, 0)
 		if err != nil {
 			return nil, err
 		}
+		bks = append(bks, bk)
+	}
+	r, err := NewRedirecterWithBackends(bks, baseUrl, strict, enableCache)
+	if err != nil {
+		return nil, err
+	}
+	r.WatchFiles(files)
+	return r, nil
+}
+
+func NewRedirecterWithBackends(backends []Backend, baseUrl string, strict bool, enableCache bool) (*Redirecter, error) {
+	snowflake.Epoch = snowflakeEpoch // for the creation time on info pages
+	bks := make(map[int64]Backend)
+	for _, bk := range backends {
 		nodeId, err := bk.getNodeId()
 		if err != nil {
 			return nil, err
@@ -28,132 +48,647 @@ func NewRedirecter(files []string, baseUrl string, strict bool, enableCache bool
 		if _, ok := bks[nodeId]; ok {
 			return nil, fmt.Errorf("duplicated nodeIds in files provided on node ID %d", nodeId)
 		}
+		if err = checkAliases(bk, nodeId, bks); err != nil {
+			return nil, err
+		}
 		bks[nodeId] = bk
 	}
-	realBaseUrl, err := url.ParseRequestURI(baseUrl)
+	realBaseUrl, err := ParseBaseUrl(baseUrl)
 	if err != nil {
 		return nil, err
 	}
-	if realBaseUrl.Scheme == "" {
-		return nil, fmt.Errorf("baseUrl is not a full url")
-	}
-	if !strings.HasSuffix(realBaseUrl.Path, "/") {
-		realBaseUrl.Path += "/"
-	}
 
-	var urlCache *cache.Cache = nil
+	var urlCache LinkCache
 	if enableCache {
-		urlCache = createCacheWithFileWatcher(files)
+		urlCache = NewGoCache(10 * time.Minute)
 	}
-	return &Redirecter{bks, realBaseUrl, strict, urlCache}, nil
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, err
+	}
+	r := &Redirecter{
+		bks:         bks,
+		inflight:    &sync.WaitGroup{},
+		baseUrl:     realBaseUrl,
+		strict:      strict,
+		cache:       urlCache,
+		cacheTtl:    defaultCacheTtl,
+		negativeTtl: defaultNegativeTtl,
+		secret:      secret,
+		verifying:   make(chan struct{}, runtime.NumCPU()),
+	}
+	r.metrics = newMetrics(r.CacheStats, r.backends)
+	return r, nil
 }
 
-func createCacheWithFileWatcher(files []string) *cache.Cache {
-	urlCache := cache.New(5*time.Minute, 10*time.Minute)
+// Metrics serves the metrics in the Prometheus text format, e.g. on an admin port
+func (r *Redirecter) Metrics() http.Handler {
+	return r.metrics
+}
+
+// WatchFiles flushes the cache once any of the sqlite files is modified,
+// other sources (e.g. postgres DSNs) are skipped.
+func (r *Redirecter) WatchFiles(files []string) {
+	if r.cache == nil {
+		return
+	}
 
 	// fsnotify for urlCache clear
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Println("fsnotify init failed, just ignore.", err)
-	} else {
-		go func() {
-			for {
-				select {
-				case event, ok := <-watcher.Events:
-					if !ok {
-						return
-					}
-					if event.Has(fsnotify.Write) {
-						urlCache.Flush() // clear cache if DB modified
-					}
-				case err, ok := <-watcher.Errors:
-					if !ok {
-						return
-					}
-					log.Println("fsnotify error:", err)
+		return
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
 				}
+				if event.Has(fsnotify.Write) && r.modifiedExternally(event.Name) {
+					r.cache.Flush() // clear cache if DB modified
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("fsnotify error:", err)
 			}
-		}()
+		}
+	}()
+
+	for _, f := range files {
+		if !IsSqliteSource(f) {
+			continue
+		}
+		err = watcher.Add(f)
+		if err != nil {
+			log.Printf("failed on watching %v, ignored: %v", f, err)
+		}
+	}
+}
+
+// modifiedExternally tells if the sqlite file is modified by the others since
+// the last call, the writes of the backend serving it don't change the links cached
+func (r *Redirecter) modifiedExternally(filename string) bool {
+	filename = filepath.Clean(filename)
+	for _, bk := range r.backends() {
+		if s, ok := bk.(*sqliteBackend); ok && s.changes.filename == filename {
+			return s.changes.changedExternally()
+		}
+	}
+	return true
+}
+
+// SetCache replaces the cache, nil disables caching. The links are cached for
+// ttl at most, and the codes not found for negativeTtl.
+func (r *Redirecter) SetCache(c LinkCache, ttl time.Duration, negativeTtl time.Duration) {
+	r.cache = c
+	r.cacheTtl = ttl
+	r.negativeTtl = negativeTtl
+}
+
+// CacheStats returns false if caching is disabled
+func (r *Redirecter) CacheStats() (CacheStats, bool) {
+	if r.cache == nil {
+		return CacheStats{}, false
+	}
+	return r.cache.Stats(), true
+}
+
+// SetCookieSecret replaces the random secret signing the cookies of password-protected
+// links, which should be shared by the instances behind a load balancer
+func (r *Redirecter) SetCookieSecret(secret []byte) {
+	r.secret = secret
+}
+
+// SetAccessLog logs every request served, nil disables logging
+func (r *Redirecter) SetAccessLog(accessLog *AccessLog) {
+	r.accessLog = accessLog
+}
+
+func (r *Redirecter) SetHitRecorder(recorder HitRecorder) {
+	r.recorder = recorder
+}
+
+// EnableStats persists per-link per-day redirect counts into the backends
+func (r *Redirecter) EnableStats(flushInterval time.Duration) {
+	r.SetHitRecorder(NewStatsRecorder(r.withBackend, flushInterval, 4096))
+}
+
+// EnableSweeper deletes the expired links from the backends periodically
+func (r *Redirecter) EnableSweeper(interval time.Duration, batch int) *Sweeper {
+	return NewSweeper(r.eachBackend, interval, batch)
+}
 
-		for _, f := range files {
-			err = watcher.Add(f)
-			if err != nil {
-				log.Printf("failed on watching %v, ignored: %v", f, err)
+// Attach serves the links of the backend from now on, failing if its node
+// is served already or any of its aliases is defined by another node
+func (r *Redirecter) Attach(bk Backend) error {
+	nodeId, err := bk.getNodeId()
+	if err != nil {
+		return err
+	}
+	r.bksMu.RLock()
+	others := maps.Clone(r.bks)
+	r.bksMu.RUnlock()
+	if err = checkAliases(bk, nodeId, others); err != nil {
+		return err
+	}
+	r.bksMu.Lock()
+	defer r.bksMu.Unlock()
+	if _, ok := r.bks[nodeId]; ok {
+		return fmt.Errorf("node ID %d is served already", nodeId)
+	}
+	r.bks[nodeId] = bk
+	if r.cache != nil {
+		r.cache.Flush() // the codes of the node may be cached as not found
+	}
+	return nil
+}
+
+// checkAliases fails if any alias of the backend is defined by the others as
+// well, which would resolve to the link of the lowest node only
+func checkAliases(bk Backend, nodeId int64, others map[int64]Backend) error {
+	if len(others) == 0 {
+		return nil
+	}
+	aliases, err := bk.QueryAliases()
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		for otherId, other := range others {
+			if otherId == nodeId {
+				continue
+			}
+			if id, err := other.QueryAlias(alias); err != nil {
+				return err
+			} else if id != 0 {
+				return fmt.Errorf("alias %q is defined by both node %d and %d", alias, otherId, nodeId)
 			}
 		}
 	}
+	return nil
+}
+
+// Detach stops serving the links of the node, and closes its backend once the
+// requests in flight finish. It returns the channel closed after that, or nil
+// if the node is not served.
+func (r *Redirecter) Detach(nodeId int64) <-chan struct{} {
+	r.bksMu.Lock()
+	bk, ok := r.bks[nodeId]
+	if !ok {
+		r.bksMu.Unlock()
+		return nil
+	}
+	delete(r.bks, nodeId)
+	inflight := r.inflight
+	r.inflight = &sync.WaitGroup{}
+	if r.cache != nil {
+		r.cache.Flush()
+	}
+	r.bksMu.Unlock()
 
-	return urlCache
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		inflight.Wait()
+		if r.cache != nil {
+			r.cache.Flush() // the links cached by the requests in flight
+		}
+		if err := bk.Close(); err != nil {
+			log.Printf("failed on closing the backend of node %d: %v", nodeId, err)
+		}
+	}()
+	return closed
 }
 
-func (r *Redirecter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		w.WriteHeader(404)
-		_, _ = io.WriteString(w, "not found")
+// Close waits for the requests in flight, then flushes the hits recorded and
+// closes the access log & all the backends served. The redirecter must not
+// serve any request after.
+func (r *Redirecter) Close() error {
+	r.bksMu.Lock()
+	inflight := r.inflight
+	r.inflight = &sync.WaitGroup{}
+	r.bksMu.Unlock()
+	inflight.Wait()
+
+	var errs []error
+	if r.recorder != nil {
+		errs = append(errs, r.recorder.Close()) // into the backends still served
+	}
+	if r.accessLog != nil {
+		errs = append(errs, r.accessLog.Close())
+	}
+	r.bksMu.Lock()
+	bks := r.bks
+	r.bks = make(map[int64]Backend)
+	inflight = r.inflight
+	r.inflight = &sync.WaitGroup{}
+	r.bksMu.Unlock()
+	inflight.Wait() // e.g. a sweep in progress
+	for nodeId, bk := range bks {
+		if err := bk.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed on closing the backend of node %d: %v", nodeId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// enter marks a request in flight, which has to call Done on the returned
+// WaitGroup once finished
+func (r *Redirecter) enter() *sync.WaitGroup {
+	r.bksMu.RLock()
+	defer r.bksMu.RUnlock()
+	r.inflight.Add(1)
+	return r.inflight
+}
+
+// backends returns the backends ordered by node id
+func (r *Redirecter) backends() []Backend {
+	r.bksMu.RLock()
+	defer r.bksMu.RUnlock()
+	bks := make([]Backend, 0, len(r.bks))
+	for _, nodeId := range slices.Sorted(maps.Keys(r.bks)) {
+		bks = append(bks, r.bks[nodeId])
+	}
+	return bks
+}
+
+// withBackend calls fn with the backend of the node unless it's not served, the
+// backend is not closed by Detach or Close until fn returns
+func (r *Redirecter) withBackend(nodeId int64, fn func(bk Backend)) bool {
+	r.bksMu.RLock()
+	bk, ok := r.bks[nodeId]
+	inflight := r.inflight
+	if ok {
+		inflight.Add(1)
+	}
+	r.bksMu.RUnlock()
+	if !ok {
+		return false
+	}
+	defer inflight.Done()
+	fn(bk)
+	return true
+}
+
+// eachBackend calls withBackend for each node served, ordered by node id
+func (r *Redirecter) eachBackend(fn func(bk Backend)) {
+	r.bksMu.RLock()
+	nodeIds := slices.Sorted(maps.Keys(r.bks))
+	r.bksMu.RUnlock()
+	for _, nodeId := range nodeIds {
+		r.withBackend(nodeId, fn)
+	}
+}
+
+func (r *Redirecter) backend(nodeId int64) (Backend, bool) {
+	r.bksMu.RLock()
+	defer r.bksMu.RUnlock()
+	bk, ok := r.bks[nodeId]
+	return bk, ok
+}
+
+// Invalidate drops the cached entries of id, including the ones cached by aliases
+func (r *Redirecter) Invalidate(id snowflake.ID) {
+	if r.cache == nil {
 		return
 	}
+	r.cache.Delete(id.Base58())
+	r.cache.DeleteId(uint64(id))
+}
+
+func (r *Redirecter) ShortUrl(id snowflake.ID) string {
+	return ShortUrl(r.baseUrl, id.Base58())
+}
+
+// ParseBaseUrl parses the full url the short links are served under, the path
+// ends with a slash
+func ParseBaseUrl(baseUrl string) (*url.URL, error) {
+	parsed, err := url.ParseRequestURI(baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme == "" {
+		return nil, fmt.Errorf("baseUrl is not a full url")
+	}
+	if !strings.HasSuffix(parsed.Path, "/") {
+		parsed.Path += "/"
+	}
+	return parsed, nil
+}
+
+// ShortUrl formats the short link of the code, or an alias, under the base url
+// parsed by ParseBaseUrl
+func ShortUrl(baseUrl *url.URL, code string) string {
+	return baseUrl.JoinPath(code).String()
+}
+
+func (r *Redirecter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer r.enter().Done()
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: 200}
+	var served servedRequest
+	r.serve(sw, req, &served)
+	nodeId, dst := int64(-1), ""
+	if served.entry != nil {
+		nodeId = snowflake.ID(served.entry.Id).Node()
+		if served.entry.PasswordHash == "" { // never reveal the protected ones
+			dst = served.entry.Url
+		}
+	}
+	r.metrics.observeRequest(nodeId, sw.status)
+	if r.accessLog != nil {
+		uri := req.RequestURI
+		if uri == "" { // not received by a server, e.g. in tests
+			uri = req.URL.RequestURI()
+		}
+		r.accessLog.Log(&AccessLogEntry{
+			Time:       start,
+			RemoteAddr: req.RemoteAddr,
+			Method:     req.Method,
+			Uri:        uri,
+			Proto:      req.Proto,
+			Code:       served.code,
+			NodeId:     nodeId,
+			Url:        dst,
+			Status:     sw.status,
+			Bytes:      sw.bytes,
+			Latency:    time.Since(start),
+			CacheHit:   served.cacheHit,
+		})
+	}
+}
+
+// servedRequest is what a request is resolved to, for the metrics & access logs
+type servedRequest struct {
+	code     string
+	entry    *UrlEntry // nil if not resolved
+	cacheHit bool
+}
+
+// statusWriter keeps the status & the size of the body written
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (r *Redirecter) serve(w http.ResponseWriter, req *http.Request, served *servedRequest) {
+	if req.Method == "HEAD" {
+		w = bodylessWriter{w}
+	}
 	if r.strict && req.Host != r.baseUrl.Host {
 		w.WriteHeader(404)
 		_, _ = io.WriteString(w, "not found")
 		return
 	}
 	reqPathDir, reqFinalSeg := path.Split(req.URL.Path)
-	if reqPathDir != r.baseUrl.Path {
-		w.WriteHeader(404)
-		_, _ = io.WriteString(w, "not found")
+	served.code = reqFinalSeg
+	if reqPathDir == r.baseUrl.Path+"info/" && reqFinalSeg != "" {
+		r.serveInfo(w, req, reqFinalSeg)
 		return
 	}
-	if reqFinalSeg == "" {
-		w.WriteHeader(404)
-		_, _ = io.WriteString(w, "not found")
+	if reqPathDir == r.baseUrl.Path && len(reqFinalSeg) > 1 && strings.HasSuffix(reqFinalSeg, "+") {
+		r.serveInfo(w, req, strings.TrimSuffix(reqFinalSeg, "+"))
 		return
 	}
-	if r.cache != nil {
-		if cachedUrl, found := r.cache.Get(reqFinalSeg); found {
-			if cachedUrl == nil {
-				w.WriteHeader(404)
-				_, _ = io.WriteString(w, "not found")
-				return
-			}
-			http.Redirect(w, req, cachedUrl.(string), 302)
-		}
+	if ext := path.Ext(reqFinalSeg); reqPathDir == r.baseUrl.Path && len(reqFinalSeg) > len(ext) && (ext == ".png" || ext == ".svg") {
+		r.serveQr(w, req, strings.TrimSuffix(reqFinalSeg, ext), ext)
+		return
 	}
-	id, err := snowflake.ParseBase58([]byte(reqFinalSeg))
-	if err != nil {
+	if reqPathDir != r.baseUrl.Path {
 		w.WriteHeader(404)
 		_, _ = io.WriteString(w, "not found")
 		return
 	}
-	if _, ok := r.bks[id.Node()]; !ok {
+	if reqFinalSeg == "" {
 		w.WriteHeader(404)
 		_, _ = io.WriteString(w, "not found")
 		return
 	}
-	entry, err := r.bks[id.Node()].QueryById(uint64(id))
+	entry, cacheHit, err := r.cachedLookup(reqFinalSeg)
 	if err != nil {
 		log.Printf("failed on querying %s: %v", reqFinalSeg, err)
 		w.WriteHeader(500)
 		_, _ = io.WriteString(w, "temporarily error")
 		return
 	}
+	served.entry, served.cacheHit = entry, cacheHit
 	if entry == nil {
-		// cache
-		if r.cache != nil {
-			r.cache.Add(reqFinalSeg, nil, cache.DefaultExpiration)
-		}
-
 		w.WriteHeader(404)
 		_, _ = io.WriteString(w, "not found")
 		return
 	}
+	if entry.Disabled {
+		w.WriteHeader(410)
+		_, _ = io.WriteString(w, "gone")
+		return
+	}
+	if req.Method == "OPTIONS" {
+		serveOptions(w, req, entry)
+		return
+	}
+	if entry.PasswordHash != "" {
+		if !r.unlocked(req, entry) {
+			r.servePassword(w, req, entry)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	if !methodAllowed(req.Method, entry) {
+		w.Header().Set("Allow", allowedMethods(entry))
+		w.WriteHeader(405)
+		_, _ = io.WriteString(w, "method not allowed")
+		return
+	}
+	if entry.VisitsLeft.Valid && req.Method == "HEAD" {
+		// a HEAD would reveal the destination without a visit, so it gets none
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(200)
+		return
+	}
+	if entry.VisitsLeft.Valid {
+		consumed, err := r.consumeVisit(entry)
+		if err != nil {
+			log.Printf("failed on consuming a visit of %s: %v", reqFinalSeg, err)
+			w.WriteHeader(500)
+			_, _ = io.WriteString(w, "temporarily error")
+			return
+		}
+		if !consumed {
+			w.WriteHeader(404)
+			_, _ = io.WriteString(w, "not found")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	if r.recorder != nil && req.Method != "HEAD" {
+		r.recorder.Record(NewHit(entry.Id, req, r.secret))
+	}
+	http.Redirect(w, req, entry.Url, entryRedirectCode(entry))
+}
 
-	//cache
-	if r.cache != nil {
-		if !entry.ExpireAt.Valid {
-			r.cache.Set(reqFinalSeg, entry.Url, cache.DefaultExpiration)
+func (r *Redirecter) consumeVisit(entry *UrlEntry) (bool, error) {
+	bk, ok := r.backend(snowflake.ID(entry.Id).Node())
+	if !ok {
+		return false, nil
+	}
+	return bk.ConsumeVisit(entry.Id)
+}
+
+func entryRedirectCode(entry *UrlEntry) int {
+	if entry.RedirectCode == 0 {
+		return 302
+	}
+	return entry.RedirectCode
+}
+
+// methodAllowed accepts GET & HEAD only, unless the redirect code preserves the method & body
+func methodAllowed(method string, entry *UrlEntry) bool {
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+	code := entryRedirectCode(entry)
+	return code == 307 || code == 308
+}
+
+func allowedMethods(entry *UrlEntry) string {
+	code := entryRedirectCode(entry)
+	if code == 307 || code == 308 {
+		return "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	}
+	return "GET, HEAD, OPTIONS"
+}
+
+// serveOptions answers OPTIONS, including CORS preflight requests
+func serveOptions(w http.ResponseWriter, req *http.Request, entry *UrlEntry) {
+	allowed := allowedMethods(entry)
+	w.Header().Set("Allow", allowed)
+	if req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", allowed)
+		if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", "86400")
+	}
+	w.WriteHeader(204)
+}
+
+// bodylessWriter drops the body for HEAD requests
+type bodylessWriter struct {
+	http.ResponseWriter
+}
+
+func (w bodylessWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// lookup returns the active entry of code, and the id code resolves to even if not found
+func (r *Redirecter) lookup(code string) (*UrlEntry, snowflake.ID, error) {
+	id, err := snowflake.ParseBase58([]byte(code))
+	if err == nil {
+		if bk, ok := r.backend(id.Node()); ok {
+			entry, err := r.queryById(bk, id)
+			if err != nil || entry != nil {
+				return entry, id, err
+			}
 		} else {
-			r.cache.Set(reqFinalSeg, entry.Url, time.Unix(entry.ExpireAt.Int64, 0).Sub(time.Now()))
+			id = 0
 		}
+	} else {
+		id = 0
+	}
+	// fallback to vanity aliases
+	for _, bk := range r.backends() {
+		aliasedId, err := bk.QueryAlias(code)
+		if err != nil {
+			return nil, 0, err
+		}
+		if aliasedId == 0 {
+			continue
+		}
+		if target, ok := r.backend(snowflake.ID(aliasedId).Node()); ok {
+			entry, err := r.queryById(target, snowflake.ID(aliasedId))
+			return entry, snowflake.ID(aliasedId), err
+		}
+	}
+	return nil, id, nil
+}
+
+// cachedLookup looks the code up in the cache first, then in the backends,
+// caching the result except the limited links whose visits have to be
+// counted by the backends
+func (r *Redirecter) cachedLookup(code string) (entry *UrlEntry, cacheHit bool, err error) {
+	if r.cache == nil {
+		entry, _, err = r.lookup(code)
+		return entry, false, err
+	}
+	if entry, found := r.cache.Get(code); found {
+		return entry, true, nil
+	}
+	entry, id, err := r.lookup(code)
+	if err != nil {
+		return nil, false, err
+	}
+	if entry == nil {
+		r.cache.Set(code, nil, r.notFoundTtl(id))
+	} else if !entry.VisitsLeft.Valid {
+		ttl := r.cacheTtl
+		if entry.ExpireAt.Valid {
+			ttl = min(ttl, time.Until(time.Unix(entry.ExpireAt.Int64, 0)))
+		}
+		r.cache.Set(code, entry, max(ttl, time.Millisecond))
+	}
+	return entry, false, nil
+}
+
+// queryById queries the backend of the node of id, observing the latency
+func (r *Redirecter) queryById(bk Backend, id snowflake.ID) (*UrlEntry, error) {
+	start := time.Now()
+	entry, err := bk.QueryById(uint64(id))
+	result := "found"
+	if err != nil {
+		result = "error"
+	} else if entry == nil {
+		result = "not_found"
+	}
+	r.metrics.observeQuery(id.Node(), result, time.Since(start))
+	return entry, err
+}
+
+// notFoundTtl keeps a link not active yet from being cached as not found after its activation
+func (r *Redirecter) notFoundTtl(id snowflake.ID) time.Duration {
+	bk, ok := r.backend(id.Node())
+	if id == 0 || !ok {
+		return r.negativeTtl
+	}
+	pending, err := bk.QueryPending(uint64(id))
+	if err != nil {
+		log.Printf("failed on querying pending link %s: %v", id.Base58(), err)
+		return r.negativeTtl
+	}
+	if pending == nil {
+		return r.negativeTtl
 	}
-	http.Redirect(w, req, entry.Url, 302)
+	return max(min(r.negativeTtl, time.Until(time.Unix(pending.ActivateAt.Int64, 0))), time.Millisecond)
 }
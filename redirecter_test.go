@@ -2,12 +2,14 @@ package shorturl
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/bwmarrin/snowflake"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -23,6 +25,24 @@ func randStr(n int) string {
 	return string(b)
 }
 
+// newTestRedirecter serves a memory backend of the node with the cache enabled
+func newTestRedirecter(t *testing.T, base string, nodeId int64) (*Redirecter, *Manager) {
+	bk, err := MemoryOpen(nodeId)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	redirecter, err := NewRedirecterWithBackends([]Backend{bk}, base, false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	t.Cleanup(func() { _ = bk.Close() })
+	return redirecter, mgr
+}
+
 func deleteId(files []string, idStr string, t *testing.T) {
 	id, err := snowflake.ParseBase58([]byte(idStr))
 	if err != nil {
@@ -139,7 +159,11 @@ func TestRedirecter_strict(t *testing.T) {
 	testCommon(t, idUrlMap, redirecter, expiredAt, expiringId, nonexists, "https://r.mrzm.io/strict")
 
 	for k, _ := range idUrlMap {
-		check404("POST", "https://r.mrzm.io/strict/"+k, redirecter, t)
+		if _, ok := expiringId[k]; ok {
+			check404("POST", "https://r.mrzm.io/strict/"+k, redirecter, t)
+		} else {
+			checkStatus("POST", "https://r.mrzm.io/strict/"+k, 405, redirecter, t)
+		}
 		check404("GET", "https://r.mrzm.io/"+k, redirecter, t)
 		check404("GET", "https://mrzm.io/strict/"+k, redirecter, t)
 	}
@@ -169,6 +193,14 @@ func TestRedirecter_fsnotify(t *testing.T) {
 	}
 	deleteId(files, idToDelete, t)
 	delete(idUrlMap, idToDelete)
+	// wait for fsnotify flushing the cache
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		rr := httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, httptest.NewRequest("GET", "https://r.mrzm.io/fsnotify/"+idToDelete, nil))
+		if rr.Code == 404 {
+			break
+		}
+	}
 	check404("GET", "https://r.mrzm.io/fsnotify/"+idToDelete, redirecter, t)
 	for k, v := range idUrlMap {
 		if _, ok := expiringId[k]; ok {
@@ -304,3 +336,430 @@ func testCommon(t *testing.T, idUrlMap map[string]string, redirecter *Redirecter
 		check404("GET", baseUrlUrl.JoinPath(ne).String(), redirecter, t)
 	}
 }
+
+func TestRedirecter_Alias(t *testing.T) {
+	files, idUrlMap, expiringId, _, _ := initTest(2, 10, t)
+	redirecter, err := NewRedirecter(files, "https://r.mrzm.io/alias", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+
+	aliases := make(map[string]string)
+	for k, v := range idUrlMap {
+		if _, ok := expiringId[k]; ok {
+			continue
+		}
+		id, err := snowflake.ParseBase58([]byte(k))
+		if err != nil {
+			t.Fatal("wrong id.", err)
+		}
+		bk, err := SqliteOpen(files[id.Node()], true, id.Node())
+		if err != nil {
+			t.Fatal("failed on opening db.", err)
+		}
+		alias := "sale-" + k
+		if err = bk.InsertAlias(alias, uint64(id)); err != nil {
+			t.Fatal("failed on inserting alias.", err)
+		}
+		_ = bk.Close()
+		aliases[alias] = v
+	}
+
+	for alias, v := range aliases {
+		check302("GET", "https://r.mrzm.io/alias/"+alias, v, redirecter, t)
+	}
+	check404("GET", "https://r.mrzm.io/alias/sale-nothing", redirecter, t)
+}
+
+func TestRedirecter_AliasCollision(t *testing.T) {
+	var bks []Backend
+	for nodeId := int64(1); nodeId <= 2; nodeId++ {
+		bk, err := MemoryOpen(nodeId)
+		if err != nil {
+			t.Fatal("failed on creating memory backend.", err)
+		}
+		mgr, err := NewManager(bk)
+		if err != nil {
+			t.Fatal("failed to create manager.", err)
+		}
+		id, err := mgr.InsertOrReuse("https://example.mrzm.io/"+randStr(18), -1)
+		if err != nil {
+			t.Fatal("failed on insert.", err)
+		}
+		if err = mgr.ReserveAlias("collided", id); err != nil {
+			t.Fatal("failed on reserving alias.", err)
+		}
+		bks = append(bks, bk)
+	}
+	if _, err := NewRedirecterWithBackends(bks, "https://r.mrzm.io/collision", false, true); err == nil {
+		t.Fatal("should fail on the alias defined by both nodes")
+	}
+	redirecter, err := NewRedirecterWithBackends(bks[:1], "https://r.mrzm.io/collision", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	if err = redirecter.Attach(bks[1]); err == nil {
+		t.Fatal("should fail on attaching the alias defined already")
+	}
+}
+
+func TestRedirecter_Stats(t *testing.T) {
+	files, idUrlMap, expiringId, _, _ := initTest(2, 10, t)
+	redirecter, err := NewRedirecter(files, "https://r.mrzm.io/stats", false, false)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	recorder := NewStatsRecorder(redirecter.withBackend, time.Hour, 1024)
+	redirecter.SetHitRecorder(recorder)
+
+	var code string
+	for k := range idUrlMap {
+		if _, ok := expiringId[k]; !ok {
+			code = k
+			break
+		}
+	}
+	for i := 0; i < 3; i++ {
+		check302("GET", "https://r.mrzm.io/stats/"+code, idUrlMap[code], redirecter, t)
+	}
+	check404("GET", "https://r.mrzm.io/stats/nothing", redirecter, t)
+	if err = recorder.Close(); err != nil {
+		t.Fatal("failed on closing recorder.", err)
+	}
+
+	id, err := snowflake.ParseBase58([]byte(code))
+	if err != nil {
+		t.Fatal("wrong id.", err)
+	}
+	counts, err := redirecter.bks[id.Node()].QueryHitCounts(uint64(id))
+	if err != nil {
+		t.Fatal("failed on querying hit counts.", err)
+	}
+	if len(counts) != 1 || counts[0].Count != 3 || counts[0].Day != time.Now().UTC().Format(hitDayLayout) {
+		t.Fatal("hit counts not match", counts)
+	}
+}
+
+func TestAnonymizeIp(t *testing.T) {
+	secret := []byte("secret")
+	if anonymizeIp(secret, "192.0.2.10:1234") != anonymizeIp(secret, "192.0.2.200:4321") {
+		t.Error("same /24 should be hashed identically")
+	}
+	if anonymizeIp(secret, "192.0.2.10:1234") == anonymizeIp(secret, "192.0.3.10:1234") {
+		t.Error("different /24 should differ")
+	}
+	if anonymizeIp(secret, "[2001:db8:1::1]:80") != anonymizeIp(secret, "[2001:db8:1:2::2]:80") {
+		t.Error("same /48 should be hashed identically")
+	}
+	if anonymizeIp(secret, "192.0.2.10:1234") == anonymizeIp([]byte("other"), "192.0.2.10:1234") {
+		t.Error("should be keyed by the secret")
+	}
+	if anonymizeIp(secret, "garbage") != "" {
+		t.Error("invalid address should be empty")
+	}
+}
+
+func TestRedirecter_Disabled(t *testing.T) {
+	files, idUrlMap, expiringId, _, _ := initTest(1, 10, t)
+	redirecter, err := NewRedirecter(files, "https://r.mrzm.io/disabled", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	bk, err := SqliteOpen(files[0], true, 0)
+	if err != nil {
+		t.Fatal("failed on opening db.", err)
+	}
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+
+	var code string
+	for k := range idUrlMap {
+		if _, ok := expiringId[k]; !ok {
+			code = k
+			break
+		}
+	}
+	id, err := snowflake.ParseBase58([]byte(code))
+	if err != nil {
+		t.Fatal("wrong id.", err)
+	}
+	check302("GET", "https://r.mrzm.io/disabled/"+code, idUrlMap[code], redirecter, t)
+
+	if err = mgr.Disable(id); err != nil {
+		t.Fatal("failed on disable.", err)
+	}
+	redirecter.Invalidate(id)
+	checkStatus("GET", "https://r.mrzm.io/disabled/"+code, 410, redirecter, t)
+	checkStatus("GET", "https://r.mrzm.io/disabled/"+code, 410, redirecter, t)
+
+	if err = mgr.Enable(id); err != nil {
+		t.Fatal("failed on enable.", err)
+	}
+	redirecter.Invalidate(id)
+	check302("GET", "https://r.mrzm.io/disabled/"+code, idUrlMap[code], redirecter, t)
+
+	if err = mgr.Delete(id); err != nil {
+		t.Fatal("failed on delete.", err)
+	}
+	redirecter.Invalidate(id)
+	check404("GET", "https://r.mrzm.io/disabled/"+code, redirecter, t)
+}
+
+func checkStatus(method string, url string, status int, redirecter *Redirecter, t *testing.T) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal("failed on creating http req.", err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	redirecter.ServeHTTP(rr, req)
+	if rr.Result().StatusCode != status {
+		t.Errorf("not %d, got %d", status, rr.Result().StatusCode)
+	}
+}
+
+func TestRedirecter_Memory(t *testing.T) {
+	var bks []Backend
+	urls := make(map[string]string)
+	for i := int64(0); i < 3; i++ {
+		bk, err := MemoryOpen(i)
+		if err != nil {
+			t.Fatal("failed on creating memory backend.", err)
+		}
+		mgr, err := NewManager(bk)
+		if err != nil {
+			t.Fatal("failed to create manager.", err)
+		}
+		for j := 0; j < 10; j++ {
+			url := "https://example.mrzm.io/" + randStr(18)
+			id, err := mgr.InsertOrReuse(url, -1)
+			if err != nil {
+				t.Fatal("failed on insert.", err)
+			}
+			urls[id.Base58()] = url
+		}
+		bks = append(bks, bk)
+	}
+	redirecter, err := NewRedirecterWithBackends(bks, "https://r.mrzm.io/memory", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	for k, v := range urls {
+		check302("GET", "https://r.mrzm.io/memory/"+k, v, redirecter, t)
+	}
+	check404("GET", "https://r.mrzm.io/memory/nothing", redirecter, t)
+
+	if _, err = NewRedirecterWithBackends(append(bks, bks[0]), "https://r.mrzm.io", false, true); err == nil {
+		t.Fatal("should fail on duplicated node ids")
+	}
+}
+
+func TestRedirecter_RedirectCode(t *testing.T) {
+	redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/code", 0)
+	for _, code := range []int{0, 301, 302, 307, 308} {
+		dst := "https://example.mrzm.io/" + randStr(18)
+		id, err := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, RedirectCode: code})
+		if err != nil {
+			t.Fatal("failed on insert.", err)
+		}
+		expected := code
+		if code == 0 {
+			expected = 302
+		}
+		for i := 0; i < 2; i++ { // the 2nd one is served from the cache
+			checkRedirect("GET", "https://r.mrzm.io/code/"+id.Base58(), expected, dst, redirecter, t)
+			if expected == 307 || expected == 308 {
+				checkRedirect("POST", "https://r.mrzm.io/code/"+id.Base58(), expected, dst, redirecter, t)
+			} else {
+				checkStatus("POST", "https://r.mrzm.io/code/"+id.Base58(), 405, redirecter, t)
+			}
+		}
+	}
+	if _, err := mgr.InsertOrReuseWithOptions("https://example.mrzm.io/bad", LinkOptions{ExpireAt: -1, RedirectCode: 303}); err == nil {
+		t.Fatal("should fail on unsupported code")
+	}
+}
+
+func checkRedirect(method string, reqUrl string, status int, expectedLocation string, redirecter *Redirecter, t *testing.T) {
+	req, err := http.NewRequest(method, reqUrl, nil)
+	if err != nil {
+		t.Fatal("failed on creating http req.", err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	redirecter.ServeHTTP(rr, req)
+	if rr.Result().StatusCode != status {
+		t.Errorf("not %d, got %d", status, rr.Result().StatusCode)
+	}
+	url, err := rr.Result().Location()
+	if err != nil {
+		t.Error("failed on get location.", err)
+	} else if url.String() != expectedLocation {
+		t.Error("redirect location not match")
+	}
+}
+
+func TestRedirecter_Methods(t *testing.T) {
+	redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/method", 0)
+	dst := "https://example.mrzm.io/" + randStr(18)
+	id, err := mgr.InsertOrReuse(dst, -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	preserved, err := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, RedirectCode: 307})
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	reqUrl := "https://r.mrzm.io/method/" + id.Base58()
+	for i := 0; i < 2; i++ { // the 2nd one is served from the cache
+		req := httptest.NewRequest("HEAD", reqUrl, nil)
+		rr := httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, req)
+		if rr.Code != 302 || rr.Header().Get("Location") != dst || rr.Body.Len() != 0 {
+			t.Error("HEAD should redirect without body", rr.Code, rr.Body.Len())
+		}
+
+		req = httptest.NewRequest("OPTIONS", reqUrl, nil)
+		req.Header.Set("Origin", "https://example.mrzm.io")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rr = httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, req)
+		if rr.Code != 204 || rr.Header().Get("Allow") != "GET, HEAD, OPTIONS" || rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Error("preflight not answered", rr.Code, rr.Header())
+		}
+
+		for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+			req = httptest.NewRequest(method, reqUrl, nil)
+			rr = httptest.NewRecorder()
+			redirecter.ServeHTTP(rr, req)
+			if rr.Code != 405 || rr.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+				t.Error(method+" should not be allowed", rr.Code)
+			}
+			checkRedirect(method, "https://r.mrzm.io/method/"+preserved.Base58(), 307, dst, redirecter, t)
+		}
+	}
+	checkStatus("HEAD", "https://r.mrzm.io/method/nothing", 404, redirecter, t)
+	checkStatus("OPTIONS", "https://r.mrzm.io/method/nothing", 404, redirecter, t)
+	checkStatus("POST", "https://r.mrzm.io/method/nothing", 404, redirecter, t)
+}
+
+func TestRedirecter_Info(t *testing.T) {
+	redirecter, mgr := newTestRedirecter(t, "https://r.mrzm.io/info", 0)
+	dst := "https://example.mrzm.io/" + randStr(18)
+	expireAt := time.Now().Unix() + 3600
+	id, err := mgr.InsertOrReuse(dst, expireAt)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if err = mgr.ReserveAlias("info-alias", id); err != nil {
+		t.Fatal("failed on reserving alias.", err)
+	}
+	if err = mgr.bk.AddHitCounts([]HitCount{{uint64(id), time.Now().UTC().Format(hitDayLayout), 3}}); err != nil {
+		t.Fatal("failed on adding hit counts.", err)
+	}
+
+	for _, reqUrl := range []string{"https://r.mrzm.io/info/" + id.Base58() + "+", "https://r.mrzm.io/info/info/" + id.Base58(), "https://r.mrzm.io/info/info-alias+"} {
+		req := httptest.NewRequest("GET", reqUrl, nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, req)
+		if rr.Code != 200 {
+			t.Fatal("info not served", reqUrl, rr.Code)
+		}
+		var info linkInfo
+		if err = json.NewDecoder(rr.Body).Decode(&info); err != nil {
+			t.Fatal("failed on decoding info.", err)
+		}
+		if info.Id != id.Base58() || info.Url != dst || info.Clicks != 3 || info.ExpireAt == nil || *info.ExpireAt != expireAt {
+			t.Error("info not match", info)
+		}
+		if created := time.Unix(info.CreatedAt, 0); time.Since(created) > time.Minute || time.Until(created) > time.Second {
+			t.Error("creation time not match", created)
+		}
+
+		req = httptest.NewRequest("GET", reqUrl, nil)
+		rr = httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, req)
+		if rr.Code != 200 || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") || !strings.Contains(rr.Body.String(), dst) {
+			t.Error("html info not served", rr.Code)
+		}
+	}
+	checkStatus("POST", "https://r.mrzm.io/info/"+id.Base58()+"+", 405, redirecter, t)
+	check404("GET", "https://r.mrzm.io/info/nothing+", redirecter, t)
+	check404("GET", "https://r.mrzm.io/info/info/nothing", redirecter, t)
+	check404("GET", "https://r.mrzm.io/info/+", redirecter, t)
+	check302("GET", "https://r.mrzm.io/info/"+id.Base58(), dst, redirecter, t)
+}
+
+func TestRedirecter_MaxVisits(t *testing.T) {
+	bk := createBk(t)
+	defer bk.Close()
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	redirecter, err := NewRedirecterWithBackends([]Backend{bk}, "https://r.mrzm.io/visits", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	dst := "https://example.mrzm.io/" + randStr(18)
+	id, err := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, MaxVisits: 2})
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if reused, _ := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, MaxVisits: 2}); reused == id {
+		t.Fatal("limited links should not be reused")
+	}
+	reqUrl := "https://r.mrzm.io/visits/" + id.Base58()
+	for range 3 {
+		rr := httptest.NewRecorder()
+		redirecter.ServeHTTP(rr, httptest.NewRequest("HEAD", reqUrl, nil))
+		if rr.Code != 200 || rr.Header().Get("Location") != "" {
+			t.Error("HEAD should not reveal the destination of a limited link", rr.Code)
+		}
+	}
+	if entry, err := bk.QueryById(uint64(id)); err != nil || entry.VisitsLeft.Int64 != 2 {
+		t.Fatal("HEAD should not consume visits.", entry, err)
+	}
+	check302("GET", reqUrl, dst, redirecter, t)
+	check302("GET", reqUrl, dst, redirecter, t)
+	check404("GET", reqUrl, redirecter, t)
+	check404("HEAD", reqUrl, redirecter, t)
+}
+
+func TestRedirecter_ActivateAt(t *testing.T) {
+	bk := createBk(t)
+	defer bk.Close()
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	redirecter, err := NewRedirecterWithBackends([]Backend{bk}, "https://r.mrzm.io/activate", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	dst := "https://example.mrzm.io/" + randStr(18)
+	activateAt := time.Now().Unix() + 2
+	if _, err = mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: activateAt - 1, ActivateAt: activateAt}); err == nil {
+		t.Fatal("should fail on activating after expiry")
+	}
+	id, err := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, ActivateAt: activateAt})
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	if reused, _ := mgr.InsertOrReuseWithOptions(dst, LinkOptions{ExpireAt: -1, ActivateAt: activateAt}); reused == id {
+		t.Fatal("pending links should not be reused")
+	}
+	if reused, _ := mgr.InsertOrReuse(dst, -1); reused == id {
+		t.Fatal("pending links should not be reused by active ones")
+	}
+	reqUrl := "https://r.mrzm.io/activate/" + id.Base58()
+	check404("GET", reqUrl, redirecter, t)
+	check404("GET", reqUrl, redirecter, t) // cached as not found till the activation
+	time.Sleep(time.Until(time.Unix(activateAt, 0)) + 10*time.Millisecond)
+	check302("GET", reqUrl, dst, redirecter, t)
+}
@@ -0,0 +1,140 @@
+package shorturl
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// reloadDelay debounces the events of a directory, e.g. a db being copied in
+const reloadDelay = time.Second
+
+// DirWatcher attaches the sqlite files matching the pattern in a directory to
+// the redirecter, and detaches the ones removed or replaced.
+type DirWatcher struct {
+	r       *Redirecter
+	dir     string
+	pattern string
+	mu      sync.Mutex
+	files   map[string]watchedFile
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+type watchedFile struct {
+	nodeId int64
+	info   os.FileInfo // to tell if the file is replaced
+}
+
+// WatchDir attaches the matching files in dir, then keeps them in sync with the
+// directory. The ones failed to attach, e.g. of a node served already, are
+// skipped & retried on the next change or Reload.
+func (r *Redirecter) WatchDir(dir string, pattern string) (*DirWatcher, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(dir); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	d := &DirWatcher{r: r, dir: dir, pattern: pattern, files: make(map[string]watchedFile), watcher: watcher, done: make(chan struct{})}
+	d.Reload()
+	go d.run()
+	return d, nil
+}
+
+func (d *DirWatcher) run() {
+	defer close(d.done)
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-d.watcher.Events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			if matched, _ := filepath.Match(d.pattern, filepath.Base(event.Name)); !matched {
+				continue
+			}
+			if event.Has(fsnotify.Write) && d.r.cache != nil && d.r.modifiedExternally(event.Name) {
+				d.r.cache.Flush() // clear cache if DB modified
+			}
+			timer.Reset(reloadDelay)
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("fsnotify error:", err)
+		case <-timer.C:
+			d.Reload()
+		}
+	}
+}
+
+// Reload rescans the directory, attaching the new files & detaching the gone ones
+func (d *DirWatcher) Reload() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(d.dir, d.pattern))
+	if err != nil {
+		log.Printf("failed on scanning %s: %v", d.dir, err)
+		return
+	}
+	current := make(map[string]os.FileInfo)
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			current[p] = info
+		}
+	}
+	for p, f := range d.files {
+		if info, ok := current[p]; !ok || !os.SameFile(info, f.info) {
+			d.r.Detach(f.nodeId)
+			delete(d.files, p)
+			log.Printf("detached node %d of %s", f.nodeId, p)
+		}
+	}
+	for p, info := range current {
+		if _, ok := d.files[p]; ok {
+			continue
+		}
+		nodeId, err := d.attach(p)
+		if err != nil {
+			log.Printf("failed on attaching %s, skipped: %v", p, err)
+			continue
+		}
+		d.files[p] = watchedFile{nodeId, info}
+		log.Printf("attached node %d of %s", nodeId, p)
+	}
+}
+
+func (d *DirWatcher) attach(path string) (int64, error) {
+	bk, err := SqliteOpen(path, false, 0)
+	if err != nil {
+		return 0, err
+	}
+	nodeId, err := bk.getNodeId()
+	if err == nil {
+		err = d.r.Attach(bk)
+	}
+	if err != nil {
+		_ = bk.Close()
+		return 0, err
+	}
+	return nodeId, nil
+}
+
+// Close stops watching, the attached backends are kept.
+func (d *DirWatcher) Close() error {
+	err := d.watcher.Close()
+	<-d.done
+	return err
+}
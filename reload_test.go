@@ -0,0 +1,258 @@
+package shorturl
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingBackend blocks QueryById till unblocked, and records closing
+type blockingBackend struct {
+	Backend
+	entered chan struct{}
+	unblock chan struct{}
+	closed  atomic.Bool
+}
+
+func (b *blockingBackend) QueryById(id uint64) (*UrlEntry, error) {
+	b.entered <- struct{}{}
+	<-b.unblock
+	return b.Backend.QueryById(id)
+}
+
+func (b *blockingBackend) Close() error {
+	b.closed.Store(true)
+	return b.Backend.Close()
+}
+
+// slowSweepBackend blocks DeleteExpired till unblocked, and records sweeping after closed
+type slowSweepBackend struct {
+	Backend
+	entered    chan struct{}
+	once       sync.Once
+	unblock    chan struct{}
+	closed     atomic.Bool
+	usedClosed atomic.Bool
+}
+
+func (b *slowSweepBackend) DeleteExpired(limit int) (int64, error) {
+	if b.closed.Load() {
+		b.usedClosed.Store(true)
+	}
+	b.once.Do(func() { close(b.entered) })
+	<-b.unblock
+	return b.Backend.DeleteExpired(limit)
+}
+
+func (b *slowSweepBackend) Close() error {
+	b.closed.Store(true)
+	return b.Backend.Close()
+}
+
+func TestRedirecter_DetachWhileSweeping(t *testing.T) {
+	bk, err := MemoryOpen(11)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	slow := &slowSweepBackend{Backend: bk, entered: make(chan struct{}), unblock: make(chan struct{})}
+	redirecter, err := NewRedirecterWithBackends([]Backend{slow}, "https://r.mrzm.io/sweeping", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	sweeper := redirecter.EnableSweeper(5*time.Millisecond, 10)
+	defer sweeper.Close()
+	<-slow.entered
+	closed := redirecter.Detach(11)
+	time.Sleep(10 * time.Millisecond)
+	if slow.closed.Load() {
+		t.Fatal("should not be closed while sweeping")
+	}
+	close(slow.unblock)
+	<-closed
+	time.Sleep(20 * time.Millisecond)
+	if !slow.closed.Load() || slow.usedClosed.Load() {
+		t.Fatal("should be closed once swept, and never swept after")
+	}
+}
+
+func TestRedirecter_Detach(t *testing.T) {
+	bk, err := MemoryOpen(7)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	dst := "https://example.mrzm.io/" + randStr(18)
+	id, err := mgr.InsertOrReuse(dst, -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	blocking := &blockingBackend{Backend: bk, entered: make(chan struct{}), unblock: make(chan struct{})}
+	redirecter, err := NewRedirecterWithBackends(nil, "https://r.mrzm.io/detach", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	check404("GET", "https://r.mrzm.io/detach/"+id.Base58(), redirecter, t)
+	if err = redirecter.Attach(blocking); err != nil {
+		t.Fatal("failed on attaching.", err)
+	}
+	if err = redirecter.Attach(bk); err == nil {
+		t.Fatal("should fail on duplicated node id")
+	}
+
+	rr := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		redirecter.ServeHTTP(rr, httptest.NewRequest("GET", "https://r.mrzm.io/detach/"+id.Base58(), nil))
+	}()
+	<-blocking.entered
+	closed := redirecter.Detach(7)
+	if closed == nil || redirecter.Detach(7) != nil {
+		t.Fatal("should detach once")
+	}
+	check404("GET", "https://r.mrzm.io/detach/"+id.Base58(), redirecter, t)
+	time.Sleep(10 * time.Millisecond)
+	if blocking.closed.Load() {
+		t.Fatal("should not be closed with a request in flight")
+	}
+	close(blocking.unblock)
+	<-served
+	<-closed
+	if rr.Code != 302 || !blocking.closed.Load() {
+		t.Fatal("the request in flight should be served before closing", rr.Code)
+	}
+}
+
+func createNodeDb(t *testing.T, filename string, nodeId int64) (*Manager, string) {
+	bk, err := SqliteOpen(filename, true, nodeId)
+	if err != nil {
+		t.Fatal("failed on creating db.", err)
+	}
+	defer bk.Close()
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	dst := "https://example.mrzm.io/" + randStr(18)
+	id, err := mgr.InsertOrReuse(dst, -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	return mgr, id.Base58()
+}
+
+func TestRedirecter_WatchDir(t *testing.T) {
+	dir := t.TempDir()
+	_, code1 := createNodeDb(t, filepath.Join(dir, "node1.db"), 1)
+	redirecter, err := NewRedirecterWithBackends(nil, "https://r.mrzm.io/dir", false, true)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	watcher, err := redirecter.WatchDir(dir, "*.db")
+	if err != nil {
+		t.Fatal("failed on watching dir.", err)
+	}
+	defer watcher.Close()
+	checkStatus("GET", "https://r.mrzm.io/dir/"+code1, 302, redirecter, t)
+
+	_, code2 := createNodeDb(t, filepath.Join(dir, "node2.db"), 2)
+	_, duplicated := createNodeDb(t, filepath.Join(dir, "node1-copy.db"), 1)
+	_, ignored := createNodeDb(t, filepath.Join(dir, "node3.sqlite"), 3)
+	checkStatus("GET", "https://r.mrzm.io/dir/"+code2, 404, redirecter, t)
+	watcher.Reload()
+	checkStatus("GET", "https://r.mrzm.io/dir/"+code2, 302, redirecter, t)
+	checkStatus("GET", "https://r.mrzm.io/dir/"+duplicated, 404, redirecter, t)
+	checkStatus("GET", "https://r.mrzm.io/dir/"+ignored, 404, redirecter, t)
+
+	if err = os.Remove(filepath.Join(dir, "node2.db")); err != nil {
+		t.Fatal("failed on removing db.", err)
+	}
+	watcher.Reload()
+	checkStatus("GET", "https://r.mrzm.io/dir/"+code2, 404, redirecter, t)
+	checkStatus("GET", "https://r.mrzm.io/dir/"+code1, 302, redirecter, t)
+
+	// picked up by the watcher without reloading explicitly
+	if err = os.Remove(filepath.Join(dir, "node1.db")); err != nil {
+		t.Fatal("failed on removing db.", err)
+	}
+	watched := func(name string) bool {
+		watcher.mu.Lock()
+		defer watcher.mu.Unlock()
+		_, ok := watcher.files[filepath.Join(dir, name)]
+		return ok
+	}
+	for i := 0; i < 30 && watched("node1.db"); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	checkStatus("GET", "https://r.mrzm.io/dir/"+code1, 404, redirecter, t)
+	// node 1 is free for the copy now
+	checkStatus("GET", "https://r.mrzm.io/dir/"+duplicated, 302, redirecter, t)
+}
+
+func TestRedirecter_Close(t *testing.T) {
+	bk, err := MemoryOpen(9)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	mgr, err := NewManager(bk)
+	if err != nil {
+		t.Fatal("failed to create manager.", err)
+	}
+	dst := "https://example.mrzm.io/" + randStr(18)
+	id, err := mgr.InsertOrReuse(dst, -1)
+	if err != nil {
+		t.Fatal("failed on insert.", err)
+	}
+	other, err := MemoryOpen(10)
+	if err != nil {
+		t.Fatal("failed on creating memory backend.", err)
+	}
+	blocking := &blockingBackend{Backend: bk, entered: make(chan struct{}), unblock: make(chan struct{})}
+	otherBlocking := &blockingBackend{Backend: other}
+	redirecter, err := NewRedirecterWithBackends([]Backend{blocking, otherBlocking}, "https://r.mrzm.io/close", false, false)
+	if err != nil {
+		t.Fatal("failed on creating redirecter.", err)
+	}
+	var buf bytes.Buffer
+	redirecter.SetAccessLog(NewAccessLog(&buf, AccessLogJson, 1, 16))
+	redirecter.EnableStats(time.Hour)
+
+	rr := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		redirecter.ServeHTTP(rr, httptest.NewRequest("GET", "https://r.mrzm.io/close/"+id.Base58(), nil))
+	}()
+	<-blocking.entered
+	closed := make(chan error)
+	go func() {
+		closed <- redirecter.Close()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if blocking.closed.Load() || otherBlocking.closed.Load() {
+		t.Fatal("should not be closed with a request in flight")
+	}
+	close(blocking.unblock)
+	<-served
+	if err = <-closed; err != nil {
+		t.Fatal("failed on closing.", err)
+	}
+	if rr.Code != 302 || !blocking.closed.Load() || !otherBlocking.closed.Load() {
+		t.Fatal("all the backends should be closed after the request in flight", rr.Code)
+	}
+	if !strings.Contains(buf.String(), `"status":302`) {
+		t.Fatal("access log not flushed", buf.String())
+	}
+	if counts, err := bk.QueryHitCounts(uint64(id)); err != nil || len(counts) != 1 || counts[0].Count != 1 {
+		t.Fatal("hit counts not flushed before closing the backends", counts, err)
+	}
+}
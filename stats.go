@@ -0,0 +1,141 @@
+package shorturl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/bwmarrin/snowflake"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const hitDayLayout = "2006-01-02"
+
+type Hit struct {
+	Id        uint64
+	Time      time.Time
+	Referrer  string
+	UserAgent string
+	ClientIp  string // truncated & keyed hashed, see anonymizeIp
+}
+
+type HitRecorder interface {
+	Record(hit *Hit)
+	Close() error
+}
+
+// StatsRecorder buffers hits in memory and persists per-link per-day counts
+// into the backend of each link periodically, so redirects are never blocked
+// on the DB writes. with calls fn with the backend of the node, which must stay
+// open until fn returns, or returns false if the node is not served.
+type StatsRecorder struct {
+	with     func(nodeId int64, fn func(bk Backend)) bool
+	hits     chan *Hit
+	dropped  atomic.Int64
+	interval time.Duration
+	wg       sync.WaitGroup
+}
+
+type hitKey struct {
+	id  uint64
+	day string
+}
+
+func NewStatsRecorder(with func(nodeId int64, fn func(bk Backend)) bool, flushInterval time.Duration, bufferSize int) *StatsRecorder {
+	s := &StatsRecorder{with: with, hits: make(chan *Hit, bufferSize), interval: flushInterval}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// NewHit hashes the client ip keyed by the secret, see anonymizeIp
+func NewHit(id uint64, req *http.Request, secret []byte) *Hit {
+	return &Hit{
+		Id:        id,
+		Time:      time.Now(),
+		Referrer:  req.Referer(),
+		UserAgent: req.UserAgent(),
+		ClientIp:  anonymizeIp(secret, req.RemoteAddr),
+	}
+}
+
+// Record never blocks; hits are dropped if the buffer is full.
+func (s *StatsRecorder) Record(hit *Hit) {
+	select {
+	case s.hits <- hit:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *StatsRecorder) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close stops accepting hits and flushes the pending counts.
+func (s *StatsRecorder) Close() error {
+	close(s.hits)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *StatsRecorder) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	pending := make(map[hitKey]int64)
+	for {
+		select {
+		case hit, ok := <-s.hits:
+			if !ok {
+				s.flush(pending)
+				return
+			}
+			pending[hitKey{hit.Id, hit.Time.UTC().Format(hitDayLayout)}]++
+		case <-ticker.C:
+			s.flush(pending)
+			pending = make(map[hitKey]int64)
+		}
+	}
+}
+
+func (s *StatsRecorder) flush(pending map[hitKey]int64) {
+	byNode := make(map[int64][]HitCount)
+	for k, count := range pending {
+		nodeId := snowflake.ID(k.id).Node()
+		byNode[nodeId] = append(byNode[nodeId], HitCount{Id: k.id, Day: k.day, Count: count})
+	}
+	for nodeId, counts := range byNode {
+		s.with(nodeId, func(bk Backend) {
+			if err := bk.AddHitCounts(counts); err != nil {
+				log.Printf("failed on saving hit counts of node %d, %d links lost: %v", nodeId, len(counts), err)
+			}
+		})
+	}
+}
+
+// anonymizeIp keeps the /24 (IPv4) or /48 (IPv6) network only and hashes it
+// by HMAC keyed with the secret, since the 2^24 networks of IPv4 could be
+// recovered by brute force from a plain hash
+func anonymizeIp(secret []byte, remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4.Mask(net.CIDRMask(24, 32))
+	} else {
+		ip = ip.Mask(net.CIDRMask(48, 128))
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(ip)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
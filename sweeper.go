@@ -0,0 +1,84 @@
+package shorturl
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepPause is the break between the batches, letting the writers blocked
+	// by a batch (e.g. the hit counts into sqlite) go first
+	sweepPause = 50 * time.Millisecond
+	cleanBatch = 1000 // links deleted per transaction by Manager.Clean
+)
+
+// Sweeper deletes the expired links of the backends periodically, in small
+// batches so the DBs are never locked for long. each calls fn with every
+// backend, which must stay open until fn returns.
+type Sweeper struct {
+	each     func(fn func(bk Backend))
+	interval time.Duration
+	batch    int
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewSweeper(each func(fn func(bk Backend)), interval time.Duration, batch int) *Sweeper {
+	s := &Sweeper{each: each, interval: interval, batch: max(batch, 1), stop: make(chan struct{})}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Close stops sweeping, waiting for the batch in progress.
+func (s *Sweeper) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Sweeper) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.each(s.sweep)
+		}
+	}
+}
+
+func (s *Sweeper) sweep(bk Backend) {
+	nodeId, _ := bk.getNodeId()
+	deleted, err := sweepExpired(bk, s.batch, func() bool {
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(sweepPause):
+			return true
+		}
+	})
+	if deleted > 0 {
+		log.Printf("swept %d expired links of node %d", deleted, nodeId)
+	}
+	if err != nil {
+		log.Printf("failed on sweeping expired links of node %d: %v", nodeId, err)
+	}
+}
+
+// sweepExpired deletes the expired links by batches until none is left, or
+// next returns false between the batches
+func sweepExpired(bk Backend, batch int, next func() bool) (int64, error) {
+	total := int64(0)
+	for {
+		deleted, err := bk.DeleteExpired(batch)
+		total += deleted
+		if err != nil || deleted < int64(batch) || !next() {
+			return total, err
+		}
+	}
+}
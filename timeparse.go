@@ -0,0 +1,98 @@
+package shorturl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseHumanDuration accepts bare seconds ("3600"), Go durations ("90m") and
+// the calendar units d & w on top of them ("2w", "3d12h"). Non-positive bare
+// seconds return 0, e.g. "-1" for never expiring.
+func ParseHumanDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, nil
+	}
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var total time.Duration
+	var rest strings.Builder
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+			j++
+		}
+		k := j
+		for k < len(s) && (s[k] < '0' || s[k] > '9') && s[k] != '.' {
+			k++
+		}
+		if j == i || k == j {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		switch s[j:k] {
+		case "d", "w":
+			n, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			unit := 24 * time.Hour
+			if s[j:k] == "w" {
+				unit *= 7
+			}
+			total += time.Duration(n * float64(unit))
+		default:
+			rest.WriteString(s[i:k])
+		}
+		i = k
+	}
+	if rest.Len() > 0 {
+		d, err := time.ParseDuration(rest.String())
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += d
+	}
+	return total, nil
+}
+
+// the layouts without zone are in the location passed to ParseHumanTime
+var humanTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// ParseHumanTime accepts unix seconds, RFC3339, or the date & time without zone
+// in loc. A date only ("2006-01-02") means the end of that day in loc, i.e. the
+// midnight of the next day.
+func ParseHumanTime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range humanTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, RFC3339, 2006-01-02[ 15:04[:05]] or unix seconds expected", s)
+}
+
+// ParseHumanStartTime is ParseHumanTime, but a date only means the start of
+// that day in loc, e.g. for the times a period begins at.
+func ParseHumanStartTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(s), loc); err == nil {
+		return t, nil
+	}
+	return ParseHumanTime(s, loc)
+}
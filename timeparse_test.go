@@ -0,0 +1,72 @@
+package shorturl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHumanDuration(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"3600":   time.Hour,
+		"90m":    90 * time.Minute,
+		"3d12h":  84 * time.Hour,
+		"2w":     14 * 24 * time.Hour,
+		"1.5d":   36 * time.Hour,
+		"1w2d3h": (9*24 + 3) * time.Hour,
+		"0":      0,
+		"-1":     0,
+	} {
+		if d, err := ParseHumanDuration(s); err != nil || d != expected {
+			t.Error("duration not match", s, d, err)
+		}
+	}
+	for _, s := range []string{"", "-5m", "2x", "d", "3dd", "1h-"} {
+		if _, err := ParseHumanDuration(s); err == nil {
+			t.Error("should refuse invalid duration", s)
+		}
+	}
+}
+
+func TestParseHumanTime(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no tzdata.", err)
+	}
+	for s, expected := range map[string]int64{
+		"1700000000":                1700000000,
+		"2030-01-31T10:00:00Z":      1896084000,
+		"2030-01-31T10:00:00+09:00": 1896051600,
+		"2030-01-31 10:00":          1896051600,
+		"2030-01-31T10:00:00":       1896051600,
+		"2030-01-31":                1896102000, // 2030-02-01T00:00:00+09:00
+	} {
+		if tm, err := ParseHumanTime(s, tokyo); err != nil || tm.Unix() != expected {
+			t.Error("time not match", s, tm, err)
+		}
+	}
+	for _, s := range []string{"", "tomorrow", "2030-13-01", "31/01/2030"} {
+		if _, err := ParseHumanTime(s, tokyo); err == nil {
+			t.Error("should refuse invalid time", s)
+		}
+	}
+}
+
+func TestParseHumanStartTime(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no tzdata.", err)
+	}
+	for s, expected := range map[string]int64{
+		"2030-01-31":       1896015600, // 2030-01-31T00:00:00+09:00
+		" 2030-01-31 ":     1896015600,
+		"2030-01-31 10:00": 1896051600,
+		"1700000000":       1700000000,
+	} {
+		if tm, err := ParseHumanStartTime(s, tokyo); err != nil || tm.Unix() != expected {
+			t.Error("time not match", s, tm, err)
+		}
+	}
+	if _, err := ParseHumanStartTime("2030-13-01", tokyo); err == nil {
+		t.Error("should refuse invalid time")
+	}
+}
@@ -3,33 +3,123 @@ package shorturl
 import (
 	"database/sql"
 	"github.com/bwmarrin/snowflake"
-	"github.com/patrickmn/go-cache"
 	"net/url"
+	"sync"
+	"time"
 )
 
 type UrlEntry struct {
-	Id       uint64
-	Url      string
-	ExpireAt sql.NullInt64
+	Id           uint64
+	Url          string
+	ExpireAt     sql.NullInt64
+	ActivateAt   sql.NullInt64 // not resolved before, active immediately if null
+	Disabled     bool
+	RedirectCode int           // 301, 302, 307 or 308
+	PasswordHash string        // empty if not protected, see HashPassword
+	VisitsLeft   sql.NullInt64 // unlimited if null, expired once reaching 0
+}
+
+// LinkOptions are the optional attributes of a new link
+type LinkOptions struct {
+	ExpireAt     int64  // unix time, never expires if <= 0
+	ActivateAt   int64  // unix time, active immediately if <= 0
+	RedirectCode int    // 302 if 0
+	Password     string // plain text, protects the link if not empty
+	MaxVisits    int64  // unlimited if <= 0
+}
+
+// LinkUpdate is the attributes changed by Manager.Update, the nil ones are kept
+type LinkUpdate struct {
+	Url          *string
+	ExpireAt     *int64 // unix time, never expires if <= 0
+	RedirectCode *int   // 302 if 0
+}
+
+// HitCount is the aggregated redirect count of a link in a day (UTC, formatted as 2006-01-02)
+type HitCount struct {
+	Id    uint64
+	Day   string
+	Count int64
+}
+
+// HistoryEntry is a previous state of a link, recorded when it's retargeted
+type HistoryEntry struct {
+	Id        uint64
+	Url       string
+	ExpireAt  sql.NullInt64
+	ChangedAt int64
+}
+
+type BackendInfo struct {
+	Kind                string
+	NodeId              int64
+	SchemaVersion       int
+	LatestSchemaVersion int
+	Urls                int64
+	Expired             int64
+	Disabled            int64
+	Aliases             int64
 }
 
 type Backend interface {
 	InsertUrl(entry *UrlEntry) error
+	// InsertUrls inserts in a transaction, returns the error of each entry
+	// in order, or a non-nil error only if the whole batch failed
+	InsertUrls(entries []UrlEntry) ([]error, error)
+	Walk(fn func(entry *UrlEntry) error) error
+	// ListUrls returns the links matching the filter, newest first
+	ListUrls(filter LinkFilter) ([]UrlEntry, error)
 	QueryByUrl(url string) ([]UrlEntry, error)
 	QueryById(id uint64) (*UrlEntry, error)
-	ClearExpired() error
+	Delete(id uint64) error
+	SetDisabled(id uint64, disabled bool) error
+	// ConsumeVisit decrements the visits left of a limited link atomically,
+	// returns false if already used up
+	ConsumeVisit(id uint64) (bool, error)
+	// QueryPending returns the link not active yet, which is hidden from QueryById
+	QueryPending(id uint64) (*UrlEntry, error)
+	// UpdateLink changes the fields set in a transaction, saving the previous
+	// url & expire_at into the history if the url changes
+	UpdateLink(id uint64, update *LinkUpdate) error
+	QueryHistory(id uint64) ([]HistoryEntry, error)
+	InsertAlias(alias string, id uint64) error
+	QueryAlias(alias string) (uint64, error)
+	// QueryAliases returns all the aliases, sorted
+	QueryAliases() ([]string, error)
+	AddHitCounts(counts []HitCount) error
+	QueryHitCounts(id uint64) ([]HitCount, error)
+	// DeleteExpired deletes up to limit expired or used-up links with their
+	// aliases, hit counts & history in a transaction, returns the number deleted
+	DeleteExpired(limit int) (int64, error)
+	Info() (*BackendInfo, error)
 	Close() error
 	getNodeId() (int64, error)
 }
 
 type Manager struct {
-	snode *snowflake.Node
-	bk    Backend
+	snode  *snowflake.Node
+	nodeId int64
+	bk     Backend
 }
 
 type Redirecter struct {
-	bks     map[int64]Backend
-	baseUrl *url.URL
-	strict  bool
-	cache   *cache.Cache
+	bksMu       sync.RWMutex
+	bks         map[int64]Backend
+	inflight    *sync.WaitGroup // the requests using the current bks, see Detach
+	baseUrl     *url.URL
+	strict      bool
+	cache       LinkCache
+	cacheTtl    time.Duration // the most a link is cached
+	negativeTtl time.Duration // the most a code not found is cached
+	recorder    HitRecorder
+	metrics     *Metrics
+	accessLog   *AccessLog
+	secret      []byte        // signs the cookies of password-protected links
+	verifying   chan struct{} // bounds the password verifications running at once
+}
+
+type Api struct {
+	mgr        *Manager
+	redirecter *Redirecter
+	token      string // the bearer token required by all the requests
 }